@@ -1,6 +1,10 @@
 package graphqlws
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+
 	"github.com/graphql-go/graphql/language/ast"
 )
 
@@ -21,39 +25,251 @@ func operationDefinitionsWithOperation(
 	return defs
 }
 
-func selectionSetsForOperationDefinitions(
-	defs []*ast.OperationDefinition,
-) []*ast.SelectionSet {
-	sets := []*ast.SelectionSet{}
+// operationForDocument returns the operation with the given name. As
+// when executing a document, the name may only be omitted if the
+// document contains a single operation.
+func operationForDocument(
+	doc *ast.Document,
+	name string,
+) (*ast.OperationDefinition, error) {
+	defs := []*ast.OperationDefinition{}
+	for _, op := range []string{"query", "mutation", "subscription"} {
+		defs = append(defs, operationDefinitionsWithOperation(doc, op)...)
+	}
+
+	if name == "" {
+		switch len(defs) {
+		case 0:
+			return nil, errors.New("Must provide an operation")
+		case 1:
+			return defs[0], nil
+		default:
+			return nil, errors.New("Must provide operation name if query contains multiple operations")
+		}
+	}
+
 	for _, def := range defs {
-		if set := def.GetSelectionSet(); set != nil {
-			sets = append(sets, set)
+		if def.Name != nil && def.Name.Value == name {
+			return def, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown operation named \"%s\"", name)
+}
+
+// operationTypeForDocument returns the type of the operation with the
+// given name (query, mutation or subscription), or an empty string if
+// there is no such operation.
+func operationTypeForDocument(doc *ast.Document, name string) string {
+	def, err := operationForDocument(doc, name)
+	if err != nil {
+		return ""
+	}
+	return def.Operation
+}
+
+func fragmentDefinitionsForDocument(
+	doc *ast.Document,
+) map[string]*ast.FragmentDefinition {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, node := range doc.Definitions {
+		if def, ok := node.(*ast.FragmentDefinition); ok && def.Name != nil {
+			fragments[def.Name.Value] = def
+		}
+	}
+	return fragments
+}
+
+// variablesWithDefaults returns the variables passed in by the client,
+// complemented with the default values declared by the operation.
+func variablesWithDefaults(
+	def *ast.OperationDefinition,
+	variables map[string]interface{},
+) map[string]interface{} {
+	out := make(map[string]interface{}, len(variables))
+	for name, value := range variables {
+		out[name] = value
+	}
+	for _, varDef := range def.VariableDefinitions {
+		name := varDef.Variable.Name.Value
+		if _, ok := out[name]; !ok && varDef.DefaultValue != nil {
+			out[name] = valueFromAST(varDef.DefaultValue, nil)
+		}
+	}
+	return out
+}
+
+// shouldIncludeSelection evaluates the @skip and @include directives
+// of a selection.
+func shouldIncludeSelection(
+	directives []*ast.Directive,
+	variables map[string]interface{},
+) bool {
+	for _, directive := range directives {
+		if directive.Name == nil {
+			continue
+		}
+		for _, arg := range directive.Arguments {
+			if arg.Name == nil || arg.Name.Value != "if" {
+				continue
+			}
+			condition, _ := valueFromAST(arg.Value, variables).(bool)
+			switch directive.Name.Value {
+			case "skip":
+				if condition {
+					return false
+				}
+			case "include":
+				if !condition {
+					return false
+				}
+			}
 		}
 	}
-	return sets
+	return true
 }
 
-func nameForSelectionSet(set *ast.SelectionSet) (string, bool) {
-	if len(set.Selections) >= 1 {
-		if field, ok := set.Selections[0].(*ast.Field); ok {
-			return field.Name.Value, true
+// fieldsForSelectionSet collects the fields of a selection set, resolving
+// fragment spreads and inline fragments into the fields they select.
+func fieldsForSelectionSet(
+	set *ast.SelectionSet,
+	fragments map[string]*ast.FragmentDefinition,
+	variables map[string]interface{},
+	visited map[string]bool,
+) []SubscriptionField {
+	fields := []SubscriptionField{}
+	if set == nil {
+		return fields
+	}
+
+	for _, selection := range set.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if !shouldIncludeSelection(selection.Directives, variables) {
+				continue
+			}
+			field := SubscriptionField{
+				Name:      selection.Name.Value,
+				Alias:     selection.Name.Value,
+				Arguments: argumentsForField(selection, variables),
+			}
+			if selection.Alias != nil {
+				field.Alias = selection.Alias.Value
+			}
+			fields = append(fields, field)
+
+		case *ast.FragmentSpread:
+			if !shouldIncludeSelection(selection.Directives, variables) {
+				continue
+			}
+
+			// Guard against fragment cycles; these are rejected by the
+			// validation already, but better safe than sorry
+			name := selection.Name.Value
+			fragment := fragments[name]
+			if fragment == nil || visited[name] {
+				continue
+			}
+			visited[name] = true
+			fields = append(fields, fieldsForSelectionSet(
+				fragment.SelectionSet,
+				fragments,
+				variables,
+				visited,
+			)...)
+			delete(visited, name)
+
+		case *ast.InlineFragment:
+			if !shouldIncludeSelection(selection.Directives, variables) {
+				continue
+			}
+			fields = append(fields, fieldsForSelectionSet(
+				selection.SelectionSet,
+				fragments,
+				variables,
+				visited,
+			)...)
 		}
 	}
-	return "", false
+	return fields
+}
+
+func argumentsForField(
+	field *ast.Field,
+	variables map[string]interface{},
+) map[string]interface{} {
+	args := make(map[string]interface{}, len(field.Arguments))
+	for _, arg := range field.Arguments {
+		args[arg.Name.Value] = valueFromAST(arg.Value, variables)
+	}
+	return args
 }
 
-func namesForSelectionSets(sets []*ast.SelectionSet) []string {
+// valueFromAST converts a literal argument value into a Go value,
+// substituting variables along the way. Unlike graphql-go's own
+// coercion, this works without type information and is only meant
+// for matching subscriptions against published arguments.
+func valueFromAST(value ast.Value, variables map[string]interface{}) interface{} {
+	switch v := value.(type) {
+	case *ast.Variable:
+		return variables[v.Name.Value]
+	case *ast.IntValue:
+		if i, err := strconv.Atoi(v.Value); err == nil {
+			return i
+		}
+		return v.Value
+	case *ast.FloatValue:
+		if f, err := strconv.ParseFloat(v.Value, 64); err == nil {
+			return f
+		}
+		return v.Value
+	case *ast.StringValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	case *ast.ListValue:
+		values := make([]interface{}, len(v.Values))
+		for i, item := range v.Values {
+			values[i] = valueFromAST(item, variables)
+		}
+		return values
+	case *ast.ObjectValue:
+		fields := make(map[string]interface{}, len(v.Fields))
+		for _, field := range v.Fields {
+			fields[field.Name.Value] = valueFromAST(field.Value, variables)
+		}
+		return fields
+	}
+	return nil
+}
+
+func namesForSubscriptionFields(fields []SubscriptionField) []string {
 	names := []string{}
-	for _, set := range sets {
-		if name, ok := nameForSelectionSet(set); ok {
-			names = append(names, name)
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if !seen[field.Name] {
+			seen[field.Name] = true
+			names = append(names, field.Name)
 		}
 	}
 	return names
 }
 
-func subscriptionFieldNamesFromDocument(doc *ast.Document) []string {
-	defs := operationDefinitionsWithOperation(doc, "subscription")
-	sets := selectionSetsForOperationDefinitions(defs)
-	return namesForSelectionSets(sets)
+// subscriptionFieldsFromDocument extracts the top-level fields selected
+// by a subscription operation of a document.
+func subscriptionFieldsFromDocument(
+	doc *ast.Document,
+	def *ast.OperationDefinition,
+	variables map[string]interface{},
+) []SubscriptionField {
+	if def.Operation != "subscription" {
+		return []SubscriptionField{}
+	}
+	return fieldsForSelectionSet(
+		def.GetSelectionSet(),
+		fragmentDefinitionsForDocument(doc),
+		variablesWithDefaults(def, variables),
+		make(map[string]bool),
+	)
 }
@@ -0,0 +1,65 @@
+package graphqlws
+
+// WriteBatching configures connections to write queued messages in
+// batches, which reduces the number of writes (and syscalls) when many
+// results are published in bursts.
+type WriteBatching struct {
+	// MaxMessages is the maximum number of queued messages written in one
+	// batch; it is also the number of messages that can be queued without
+	// blocking the sender. Batching is disabled if zero.
+	MaxMessages int
+
+	// SingleFrame writes all messages of a batch in a single frame,
+	// separated by newlines, if the transport is a BatchTransport. Only
+	// enable this for clients that split frames into messages (like the
+	// Client of this package); graphql-ws clients in general expect one
+	// message per frame.
+	SingleFrame bool
+
+	// Coalesce drops data messages that are superseded by a newer data
+	// message for the same operation in the same batch, so that clients
+	// that fall behind only receive the latest result.
+	Coalesce bool
+}
+
+func (batching WriteBatching) enabled() bool {
+	return batching.MaxMessages > 1
+}
+
+// drain adds the messages queued behind the first message of a batch,
+// up to the maximum batch size, without waiting for more.
+func (conn *connection) drain(batch []OperationMessage) []OperationMessage {
+	for len(batch) < conn.config.WriteBatching.MaxMessages {
+		select {
+		case msg, ok := <-conn.outgoing:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, msg)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// coalesce removes the data messages of a batch that are followed by
+// another data message for the same operation.
+func (conn *connection) coalesce(batch []OperationMessage) []OperationMessage {
+	latest := make(map[string]int)
+	for i, msg := range batch {
+		if msg.Type == gqlData {
+			latest[msg.ID] = i
+		}
+	}
+
+	coalesced := batch[:0]
+	for i, msg := range batch {
+		if msg.Type == gqlData && latest[msg.ID] != i {
+			conn.metrics.MessageDropped(msg.Type, DropReasonCoalesced)
+			continue
+		}
+		coalesced = append(coalesced, msg)
+	}
+	return coalesced
+}
@@ -0,0 +1,114 @@
+package graphqlws
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// DocumentCacheStats reports how effective a document cache is.
+type DocumentCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+// DocumentCache is a least-recently-used cache of parsed and validated
+// subscription query documents. Documents are cached per query string
+// and schema, so that clients sending identical queries (e.g. after a
+// reconnect storm) don't cause the same query to be parsed and validated
+// over and over again. A DocumentCache is safe for concurrent use and
+// may be shared between subscription managers.
+type DocumentCache struct {
+	size    int
+	entries map[documentCacheKey]*list.Element
+	order   *list.List
+	stats   DocumentCacheStats
+	mutex   *sync.Mutex
+}
+
+type documentCacheKey struct {
+	schema *graphql.Schema
+	query  string
+}
+
+type documentCacheEntry struct {
+	key        documentCacheKey
+	document   *ast.Document
+	validation graphql.ValidationResult
+}
+
+// NewDocumentCache creates a document cache that holds up to size
+// documents, evicting the least recently used documents beyond that.
+func NewDocumentCache(size int) *DocumentCache {
+	cache := new(DocumentCache)
+	cache.size = size
+	cache.entries = make(map[documentCacheKey]*list.Element)
+	cache.order = list.New()
+	cache.mutex = &sync.Mutex{}
+	return cache
+}
+
+// Stats returns the number of cache hits, misses and cached documents.
+func (cache *DocumentCache) Stats() DocumentCacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	stats := cache.stats
+	stats.Entries = cache.order.Len()
+	return stats
+}
+
+func (cache *DocumentCache) get(
+	schema *graphql.Schema,
+	query string,
+) (*ast.Document, graphql.ValidationResult, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[documentCacheKey{schema, query}]
+	if !ok {
+		cache.stats.Misses++
+		return nil, graphql.ValidationResult{}, false
+	}
+
+	cache.stats.Hits++
+	cache.order.MoveToFront(element)
+	entry := element.Value.(*documentCacheEntry)
+	return entry.document, entry.validation, true
+}
+
+func (cache *DocumentCache) add(
+	schema *graphql.Schema,
+	query string,
+	document *ast.Document,
+	validation graphql.ValidationResult,
+) {
+	if cache.size <= 0 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	key := documentCacheKey{schema, query}
+	if element, ok := cache.entries[key]; ok {
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&documentCacheEntry{
+		key:        key,
+		document:   document,
+		validation: validation,
+	})
+
+	// Evict the least recently used documents
+	for cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*documentCacheEntry).key)
+	}
+}
@@ -0,0 +1,618 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// ErrClientClosed is returned when subscribing through a closed client.
+var ErrClientClosed = errors.New("Client is closed")
+
+// DefaultAckTimeout is how long clients wait for connections to be
+// acknowledged by default.
+const DefaultAckTimeout = 10 * time.Second
+
+// DefaultResultBuffer is the number of results buffered for the consumer
+// of an operation by default.
+const DefaultResultBuffer = 16
+
+// SlowConsumerAction defines how clients deal with operations whose
+// consumer doesn't keep up with their results, once the results buffered
+// for it fill up.
+type SlowConsumerAction int
+
+const (
+	// SlowConsumerDrop drops the results that don't fit into the buffer.
+	SlowConsumerDrop SlowConsumerAction = iota
+
+	// SlowConsumerStop stops the operation and closes its channel.
+	SlowConsumerStop
+)
+
+// ClientConfig defines the configuration parameters of a GraphQL
+// WebSocket client.
+type ClientConfig struct {
+	// URL is the URL of the GraphQL WebSocket endpoint (ws:// or wss://).
+	URL string
+
+	// Header is sent along with the WebSocket upgrade request.
+	Header http.Header
+
+	// InitPayload is sent as the payload of the connection_init message,
+	// e.g. an InitMessagePayload with an auth token.
+	InitPayload interface{}
+
+	// Dialer is used to establish WebSocket connections. If nil, the
+	// default dialer of gorilla/websocket is used.
+	Dialer *websocket.Dialer
+
+	// AckTimeout is how long to wait for the server to acknowledge a
+	// connection (DefaultAckTimeout if zero).
+	AckTimeout time.Duration
+
+	// ResultBuffer is the number of results buffered for the consumer of
+	// each operation (DefaultResultBuffer if zero). Results are never
+	// waited for to be consumed, so that slow consumers don't hold up
+	// other operations; what happens once the buffer is full is decided
+	// by SlowConsumer.
+	ResultBuffer int
+
+	// SlowConsumer defines what happens to the results of operations
+	// whose consumer doesn't keep up.
+	SlowConsumer SlowConsumerAction
+
+	// Reconnect enables reconnecting when the connection drops. After
+	// reconnecting, all active operations are started again with the
+	// same IDs (and the cursor of their last result, so that servers with
+	// an event store replay missed events). If disabled, the client is
+	// closed when the connection drops.
+	Reconnect bool
+
+	// Backoff defines how long to wait between reconnection attempts.
+	Backoff Backoff
+
+	// StateChange is called whenever the state of the client changes,
+	// with the error that caused the change (if any).
+	StateChange func(ClientState, error)
+
+	// Logger is used to log what the client is doing. If nil, nothing
+	// is logged.
+	Logger Logger
+}
+
+// Client is an interface to represent GraphQL WebSocket clients, which
+// consume subscriptions from GraphQL WebSocket servers.
+type Client interface {
+	// Subscribe starts an operation (typically a subscription) and returns
+	// a channel receiving its results. The channel is closed when the
+	// server completes the operation, after delivering the errors the
+	// server rejected the operation with, when the context is cancelled
+	// (which stops the operation), when the consumer doesn't keep up with
+	// the results (with SlowConsumerStop) or when the client is closed.
+	Subscribe(context.Context, StartMessagePayload) (<-chan DataMessagePayload, error)
+
+	// Close terminates the connection to the server.
+	Close() error
+}
+
+/**
+ * The default implementation of the Client interface.
+ */
+
+type client struct {
+	config     ClientConfig
+	ws         *websocket.Conn
+	connected  bool
+	logger     Logger
+	nextID     uint64
+	operations map[string]*clientOperation
+	closed     bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	mutex      *sync.Mutex
+	writeMutex *sync.Mutex
+
+	// frame decodes the messages of the frame read last from frameWS
+	frame   *json.Decoder
+	frameWS *websocket.Conn
+}
+
+// clientOperation is an operation started by a client.
+type clientOperation struct {
+	payload StartMessagePayload
+
+	// cursor is the cursor of the last result, if the server sends
+	// cursors; it is used to resume the operation after reconnecting
+	cursor interface{}
+
+	results  chan DataMessagePayload
+	done     chan bool
+	finished bool
+	once     *sync.Once
+	mutex    *sync.Mutex
+}
+
+// clientDataMessagePayload is what data message payloads are decoded
+// into, as errors have to be decoded into a concrete type.
+type clientDataMessagePayload struct {
+	Data       interface{}                `json:"data"`
+	Errors     []gqlerrors.FormattedError `json:"errors"`
+	Extensions map[string]interface{}     `json:"extensions"`
+}
+
+// NewClient connects to a GraphQL WebSocket server and initializes the
+// connection. It returns an error if connecting fails or the server
+// rejects the connection.
+func NewClient(ctx context.Context, config ClientConfig) (Client, error) {
+	c := &client{
+		config:     config,
+		logger:     loggerForComponent(config.Logger, "client"),
+		operations: make(map[string]*clientOperation),
+		mutex:      &sync.Mutex{},
+		writeMutex: &sync.Mutex{},
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	ws, err := c.connect(ctx)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+	c.ws = ws
+	c.connected = true
+	c.changeState(ClientConnected, nil)
+
+	go c.run(ws)
+
+	return c, nil
+}
+
+// connect establishes a WebSocket connection and initializes it.
+func (c *client) connect(ctx context.Context) (*websocket.Conn, error) {
+	dialer := c.config.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	// Require the server to implement the "graphql-ws" protocol
+	d := *dialer
+	d.Subprotocols = []string{"graphql-ws"}
+	ws, _, err := d.DialContext(ctx, c.config.URL, c.config.Header)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() != "graphql-ws" {
+		ws.Close()
+		return nil, errors.New("Server does not implement the GraphQL WS protocol")
+	}
+
+	if err := c.init(ctx, ws); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// init initializes a connection and waits for it to be acknowledged.
+func (c *client) init(ctx context.Context, ws *websocket.Conn) error {
+	payload := c.config.InitPayload
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	msg := operationMessageForType(gqlConnectionInit)
+	msg.Payload = payload
+	if err := c.writeTo(ws, msg); err != nil {
+		return err
+	}
+
+	// Don't wait for the acknowledgement longer than the ack timeout or
+	// the context allow
+	timeout := c.config.AckTimeout
+	if timeout <= 0 {
+		timeout = DefaultAckTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	ws.SetReadDeadline(deadline)
+
+	// Stop waiting as soon as the context is cancelled, by moving the
+	// deadline; it is reset once nothing can move it anymore
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			ws.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+		ws.SetReadDeadline(time.Time{})
+	}()
+
+	for {
+		msg, rawPayload, err := c.read(ws)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		switch msg.Type {
+		case gqlConnectionAck:
+			c.logger.Info("Connection acknowledged")
+			return nil
+		case gqlConnectionError, gqlError:
+			return fmt.Errorf("Connection rejected: %s", errorMessageFromPayload(rawPayload))
+		case gqlConnectionKeepAlive:
+			continue
+		default:
+			return fmt.Errorf("Unexpected %s message", msg.Type)
+		}
+	}
+}
+
+func (c *client) Subscribe(
+	ctx context.Context,
+	payload StartMessagePayload,
+) (<-chan DataMessagePayload, error) {
+	buffer := c.config.ResultBuffer
+	if buffer <= 0 {
+		buffer = DefaultResultBuffer
+	}
+	op := &clientOperation{
+		payload: payload,
+		results: make(chan DataMessagePayload, buffer),
+		done:    make(chan bool),
+		once:    &sync.Once{},
+		mutex:   &sync.Mutex{},
+	}
+
+	// Register the operation and start it, unless the client is
+	// reconnecting, in which case it's started once reconnected; this
+	// happens in one go, to make sure it's not started twice
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil, ErrClientClosed
+	}
+	c.nextID++
+	id := strconv.FormatUint(c.nextID, 10)
+	c.operations[id] = op
+	if c.connected {
+		if err := c.writeTo(c.ws, startMessage(id, payload)); err != nil && !c.config.Reconnect {
+			c.mutex.Unlock()
+			c.finish(id)
+			return nil, err
+		}
+	}
+	c.mutex.Unlock()
+
+	c.logger.WithField("op", id).Debug("Started operation")
+
+	// Stop the operation when the context is cancelled
+	go func() {
+		select {
+		case <-ctx.Done():
+			if c.finish(id) {
+				msg := operationMessageForType(gqlStop)
+				msg.ID = id
+				c.write(msg)
+				c.logger.WithField("op", id).Debug("Stopped operation")
+			}
+		case <-op.done:
+		}
+	}()
+
+	return op.results, nil
+}
+
+func (c *client) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	ws, connected := c.ws, c.connected
+	c.mutex.Unlock()
+
+	// Stop reconnecting, then terminate the connection, if any; the read
+	// loop notices this and finishes all operations
+	c.cancel()
+	if connected {
+		c.writeTo(ws, operationMessageForType(gqlConnectionTerminate))
+	}
+	return ws.Close()
+}
+
+// finish unregisters an operation and closes its results channel. It
+// returns false if the operation had been finished already.
+func (c *client) finish(id string) bool {
+	c.mutex.Lock()
+	op := c.operations[id]
+	delete(c.operations, id)
+	c.mutex.Unlock()
+
+	if op == nil {
+		return false
+	}
+	op.finish()
+	return true
+}
+
+// shutdown closes the client after the connection has been lost for
+// good, finishing all operations.
+func (c *client) shutdown(reason error) {
+	c.mutex.Lock()
+	closedByUser := c.closed
+	c.closed = true
+	c.connected = false
+	operations := c.operations
+	c.operations = make(map[string]*clientOperation)
+	c.mutex.Unlock()
+
+	c.cancel()
+	for _, op := range operations {
+		op.finish()
+	}
+
+	if closedByUser {
+		reason = nil
+	}
+	c.changeState(ClientClosed, reason)
+}
+
+func (c *client) changeState(state ClientState, err error) {
+	c.logger.WithFields(LogFields{
+		"state":  state.String(),
+		"reason": err,
+	}).Info("Client state changed")
+
+	if c.config.StateChange != nil {
+		c.config.StateChange(state, err)
+	}
+}
+
+// write sends a message through the current connection.
+func (c *client) write(msg OperationMessage) error {
+	c.mutex.Lock()
+	ws := c.ws
+	c.mutex.Unlock()
+
+	return c.writeTo(ws, msg)
+}
+
+func (c *client) writeTo(ws *websocket.Conn, msg OperationMessage) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.WriteJSON(msg)
+}
+
+// read reads the next message from a connection. Frames may contain
+// several messages separated by newlines (see WriteBatching), which are
+// read one by one; reading only ever happens from one goroutine at a time.
+func (c *client) read(ws *websocket.Conn) (OperationMessage, json.RawMessage, error) {
+	if c.frame == nil || c.frameWS != ws || !c.frame.More() {
+		_, r, err := ws.NextReader()
+		if err != nil {
+			return OperationMessage{}, nil, err
+		}
+		c.frame = json.NewDecoder(r)
+		c.frameWS = ws
+	}
+
+	rawPayload := json.RawMessage{}
+	msg := OperationMessage{
+		Payload: &rawPayload,
+	}
+	err := c.frame.Decode(&msg)
+	return msg, rawPayload, err
+}
+
+// resumePayload returns the payload to start an operation again with
+// after reconnecting, which carries the cursor of the last result.
+func (op *clientOperation) resumePayload() StartMessagePayload {
+	payload := op.payload
+	if op.cursor != nil {
+		payload.Extensions = make(map[string]interface{}, len(op.payload.Extensions)+1)
+		for key, value := range op.payload.Extensions {
+			payload.Extensions[key] = value
+		}
+		payload.Extensions[cursorKey] = op.cursor
+	}
+	return payload
+}
+
+func startMessage(id string, payload StartMessagePayload) OperationMessage {
+	msg := operationMessageForType(gqlStart)
+	msg.ID = id
+	msg.Payload = payload
+	return msg
+}
+
+// run reads messages from the server until the connection drops, and
+// reconnects if this is enabled.
+func (c *client) run(ws *websocket.Conn) {
+	for {
+		err := c.readLoop(ws)
+		ws.Close()
+
+		c.mutex.Lock()
+		c.connected = false
+		closed := c.closed
+		c.mutex.Unlock()
+
+		if closed || !c.config.Reconnect {
+			c.shutdown(err)
+			return
+		}
+
+		c.logger.WithField("reason", err).Warn("Connection lost")
+		c.changeState(ClientReconnecting, err)
+
+		if ws, err = c.reconnect(); err != nil {
+			c.shutdown(err)
+			return
+		}
+	}
+}
+
+// readLoop handles the messages received from the server until reading
+// fails, e.g. because the connection was closed.
+func (c *client) readLoop(ws *websocket.Conn) error {
+	for {
+		msg, rawPayload, err := c.read(ws)
+		if err != nil {
+			return err
+		}
+
+		c.mutex.Lock()
+		op := c.operations[msg.ID]
+		c.mutex.Unlock()
+
+		switch msg.Type {
+
+		// Deliver results to the operation's channel
+		case gqlData:
+			if op == nil {
+				continue
+			}
+			payload := clientDataMessagePayload{}
+			if err := json.Unmarshal(rawPayload, &payload); err != nil {
+				c.logger.WithField("err", err).Warn("Invalid data message payload")
+				continue
+			}
+			if cursor, ok := payload.Extensions[cursorKey]; ok {
+				c.mutex.Lock()
+				op.cursor = cursor
+				c.mutex.Unlock()
+			}
+			delivered := op.deliver(DataMessagePayload{
+				Data:       payload.Data,
+				Errors:     errorsFromFormattedErrors(payload.Errors),
+				Extensions: payload.Extensions,
+			})
+			if !delivered {
+				c.overflow(msg.ID)
+			}
+
+		// Deliver the errors the operation failed with, then finish it;
+		// errors not related to an operation are only logged
+		case gqlError:
+			if op == nil {
+				c.logger.WithField("err", errorMessageFromPayload(rawPayload)).Warn("Server error")
+				continue
+			}
+			if !op.deliver(DataMessagePayload{Errors: errorsFromPayload(rawPayload)}) {
+				c.logger.WithField("op", msg.ID).Warn("Dropped errors of operation with a full buffer")
+			}
+			c.finish(msg.ID)
+
+		case gqlComplete:
+			c.finish(msg.ID)
+
+		case gqlConnectionKeepAlive:
+			continue
+
+		default:
+			c.logger.WithField("msg", msg.String()).Warn("Unhandled message")
+		}
+	}
+}
+
+// overflow deals with an operation whose consumer doesn't keep up with
+// its results, depending on the configured SlowConsumerAction.
+func (c *client) overflow(id string) {
+	if c.config.SlowConsumer != SlowConsumerStop {
+		c.logger.WithField("op", id).Warn("Dropped result of operation with a full buffer")
+		return
+	}
+
+	if c.finish(id) {
+		msg := operationMessageForType(gqlStop)
+		msg.ID = id
+		c.write(msg)
+		c.logger.WithField("op", id).Warn("Stopped operation with a full buffer")
+	}
+}
+
+// deliver queues a result for the consumer of the operation without
+// waiting for it. It returns false if the result doesn't fit into the
+// buffer of the operation.
+func (op *clientOperation) deliver(payload DataMessagePayload) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	if op.finished {
+		return true
+	}
+	select {
+	case op.results <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+func (op *clientOperation) finish() {
+	op.once.Do(func() {
+		close(op.done)
+		op.mutex.Lock()
+		op.finished = true
+		close(op.results)
+		op.mutex.Unlock()
+	})
+}
+
+func errorsFromFormattedErrors(errs []gqlerrors.FormattedError) []error {
+	if len(errs) == 0 {
+		return nil
+	}
+	out := make([]error, len(errs))
+	for i := range errs {
+		out[i] = errs[i]
+	}
+	return out
+}
+
+// errorsFromPayload decodes the payload of error messages, which is
+// either a list of errors or a single error (or error message).
+func errorsFromPayload(rawPayload json.RawMessage) []error {
+	errs := []gqlerrors.FormattedError{}
+	if err := json.Unmarshal(rawPayload, &errs); err == nil {
+		return errorsFromFormattedErrors(errs)
+	}
+	return []error{errors.New(errorMessageFromPayload(rawPayload))}
+}
+
+// errorMessageFromPayload extracts an error message from a payload that
+// is either a string or an error object.
+func errorMessageFromPayload(rawPayload json.RawMessage) string {
+	var message string
+	if err := json.Unmarshal(rawPayload, &message); err == nil {
+		return message
+	}
+	formatted := gqlerrors.FormattedError{}
+	if err := json.Unmarshal(rawPayload, &formatted); err == nil && formatted.Message != "" {
+		return formatted.Message
+	}
+	return string(rawPayload)
+}
@@ -0,0 +1,322 @@
+package graphqlws_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/gorilla/websocket"
+)
+
+func newTestClient(t *testing.T, server *httptest.Server, token string) (graphqlws.Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return graphqlws.NewClient(ctx, graphqlws.ClientConfig{
+		URL:         "ws" + strings.TrimPrefix(server.URL, "http"),
+		InitPayload: graphqlws.InitMessagePayload{AuthToken: token},
+	})
+}
+
+func receiveResult(t *testing.T, results <-chan graphqlws.DataMessagePayload) (graphqlws.DataMessagePayload, bool) {
+	select {
+	case result, ok := <-results:
+		return result, ok
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for a result")
+		return graphqlws.DataMessagePayload{}, false
+	}
+}
+
+func TestClient_SubscriptionsDeliverResults(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Authenticate: func(token string) (interface{}, error) {
+			if token == "" {
+				return nil, errors.New("No token")
+			}
+			return token, nil
+		},
+	}))
+	defer server.Close()
+
+	// Verify that rejected connections fail
+	if _, err := newTestClient(t, server, ""); err == nil {
+		t.Error("Clients of rejected connections are created")
+	}
+
+	client, err := newTestClient(t, server, "joe")
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := client.Subscribe(ctx, graphqlws.StartMessagePayload{
+		Query: "subscription { users }",
+	})
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+
+	for i := 0; len(sm.SubscriptionsForField("users", nil)) == 0; i++ {
+		if i == 100 {
+			t.Fatal("Subscription is not added")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Publish events from a different goroutine, as delivering results
+	// blocks until they are received
+	go sm.Publish(context.Background(), "users", nil)
+	result, ok := receiveResult(t, results)
+	expected := map[string]interface{}{"users": nil}
+	if !ok || !reflect.DeepEqual(result.Data, expected) || len(result.Errors) > 0 {
+		t.Error("Published results are not delivered:", result)
+	}
+
+	// Verify that cancelling the context stops the subscription
+	cancel()
+	if _, ok := receiveResult(t, results); ok {
+		t.Error("Results channel is not closed when the context is cancelled")
+	}
+	for i := 0; len(sm.SubscriptionsForField("users", nil)) > 0; i++ {
+		if i == 100 {
+			t.Fatal("Subscription is not stopped when the context is cancelled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Verify that errors are delivered before closing the channel
+	results, err = client.Subscribe(context.Background(), graphqlws.StartMessagePayload{
+		Query: "subscription { unknown }",
+	})
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	result, ok = receiveResult(t, results)
+	if !ok || len(result.Errors) != 1 ||
+		!strings.Contains(result.Errors[0].Error(), "unknown") {
+		t.Error("Errors are not delivered:", result)
+	}
+	if _, ok := receiveResult(t, results); ok {
+		t.Error("Results channel is not closed after errors")
+	}
+
+	// Verify that closing the client closes results channels
+	results, _ = client.Subscribe(context.Background(), graphqlws.StartMessagePayload{
+		Query: "subscription { users }",
+	})
+	client.Close()
+	if _, ok := receiveResult(t, results); ok {
+		t.Error("Results channel is not closed when the client is closed")
+	}
+	if _, err := client.Subscribe(context.Background(), graphqlws.StartMessagePayload{
+		Query: "subscription { users }",
+	}); err != graphqlws.ErrClientClosed {
+		t.Error("Closed clients accept subscriptions:", err)
+	}
+}
+
+func TestClient_SubscriptionsSurviveReconnects(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+	}))
+	defer server.Close()
+
+	// Keep track of the client's network connections to drop them
+	conns := make(chan net.Conn, 10)
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				conns <- conn
+			}
+			return conn, err
+		},
+	}
+
+	states := make(chan graphqlws.ClientState, 10)
+	client, err := graphqlws.NewClient(context.Background(), graphqlws.ClientConfig{
+		URL:       "ws" + strings.TrimPrefix(server.URL, "http"),
+		Dialer:    dialer,
+		Reconnect: true,
+		Backoff:   graphqlws.Backoff{InitialInterval: 10 * time.Millisecond},
+		StateChange: func(state graphqlws.ClientState, err error) {
+			states <- state
+		},
+	})
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	defer client.Close()
+
+	results, err := client.Subscribe(context.Background(), graphqlws.StartMessagePayload{
+		Query: "subscription { users }",
+	})
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+
+	waitForSubscription := func(except string) graphqlws.Connection {
+		for i := 0; i < 100; i++ {
+			for _, s := range sm.SubscriptionsForField("users", nil) {
+				if s.ID == "1" && s.Connection.ID() != except {
+					return s.Connection
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("Subscription is not added")
+		return nil
+	}
+	conn := waitForSubscription("")
+
+	// Drop the connection and verify that the client reconnects
+	(<-conns).Close()
+	for _, expected := range []graphqlws.ClientState{
+		graphqlws.ClientConnected,
+		graphqlws.ClientReconnecting,
+		graphqlws.ClientConnected,
+	} {
+		select {
+		case state := <-states:
+			if state != expected {
+				t.Fatalf("Expected client to be %s, but it is %s", expected, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Client is not %s", expected)
+		}
+	}
+
+	// Verify that the subscription is restarted with the same ID
+	waitForSubscription(conn.ID())
+	go sm.Publish(context.Background(), "users", nil)
+	if result, ok := receiveResult(t, results); !ok || len(result.Errors) > 0 {
+		t.Error("Results are not delivered after reconnecting:", result)
+	}
+
+	client.Close()
+	select {
+	case state := <-states:
+		if state != graphqlws.ClientClosed {
+			t.Error("Expected client to be closed, but it is", state)
+		}
+	case <-time.After(time.Second):
+		t.Error("Client is not closed")
+	}
+}
+
+// newUnresponsiveTestServer creates a server that accepts connections,
+// but never acknowledges them.
+func newUnresponsiveTestServer() *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"graphql-ws"}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestClient_ConnectingFailsIfConnectionsAreNotAcknowledged(t *testing.T) {
+	server := newUnresponsiveTestServer()
+	defer server.Close()
+
+	start := time.Now()
+	_, err := graphqlws.NewClient(context.Background(), graphqlws.ClientConfig{
+		URL:        "ws" + strings.TrimPrefix(server.URL, "http"),
+		AckTimeout: 50 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("Connecting succeeds without an acknowledgement")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Client waits for acknowledgements longer than the ack timeout")
+	}
+}
+
+func TestClient_ConnectingStopsWhenTheContextIsCancelled(t *testing.T) {
+	server := newUnresponsiveTestServer()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := graphqlws.NewClient(ctx, graphqlws.ClientConfig{
+		URL: "ws" + strings.TrimPrefix(server.URL, "http"),
+	})
+	if err != context.Canceled {
+		t.Error("Connecting doesn't fail with the context's error:", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Client waits for acknowledgements after the context is cancelled")
+	}
+}
+
+func TestClient_SlowConsumersDontHoldUpOtherOperations(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+	}))
+	defer server.Close()
+
+	client, err := graphqlws.NewClient(context.Background(), graphqlws.ClientConfig{
+		URL:          "ws" + strings.TrimPrefix(server.URL, "http"),
+		ResultBuffer: 2,
+		SlowConsumer: graphqlws.SlowConsumerStop,
+	})
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	defer client.Close()
+
+	payload := graphqlws.StartMessagePayload{Query: "subscription { users }"}
+	slow, err := client.Subscribe(context.Background(), payload)
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	fast, err := client.Subscribe(context.Background(), payload)
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	waitForTestSubscriptions(t, sm, 2)
+
+	// Verify that results keep arriving while another operation's
+	// consumer doesn't consume any
+	for i := 0; i < 3; i++ {
+		sm.Publish(context.Background(), "users", nil)
+		if _, ok := receiveResult(t, fast); !ok {
+			t.Fatal("Results are not delivered while another consumer is slow")
+		}
+	}
+
+	// Verify that the slow operation is stopped after its buffer is full
+	for i := 0; i < 2; i++ {
+		if _, ok := receiveResult(t, slow); !ok {
+			t.Fatal("Buffered results are not delivered")
+		}
+	}
+	if result, ok := receiveResult(t, slow); ok {
+		t.Error("Operation is not stopped when its buffer is full:", result)
+	}
+	waitForTestSubscriptions(t, sm, 1)
+}
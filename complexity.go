@@ -0,0 +1,220 @@
+package graphqlws
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ComplexityLimits defines how deep and how expensive subscription
+// queries may be. As subscriptions are executed for every event, the
+// cost of a query is multiplied by every event it is executed for.
+type ComplexityLimits struct {
+	// MaxDepth is the maximum nesting depth of fields in a query.
+	// A value of zero disables the depth limit.
+	MaxDepth int
+
+	// MaxCost is the maximum cost of a query. A value of zero disables
+	// the cost limit.
+	MaxCost int
+
+	// FieldCosts maps fields, in the form "Type.field", to the cost of
+	// selecting them. Fields not listed here cost 1.
+	FieldCosts map[string]int
+
+	// ListMultiplier is the factor that the cost of selections below a
+	// list field is multiplied with, to account for the list containing
+	// multiple items. A value of zero is treated as 1.
+	ListMultiplier int
+}
+
+// ComplexityLimitsFunc is a function that returns the complexity
+// limits for subscriptions made by a specific user.
+type ComplexityLimitsFunc func(user interface{}) ComplexityLimits
+
+// queryComplexity describes the depth and cost of a query.
+type queryComplexity struct {
+	Depth int
+	Cost  int
+}
+
+// complexityWalker computes the complexity of a query by walking its
+// selections alongside the types of the schema.
+type complexityWalker struct {
+	schema    *graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+	limits    ComplexityLimits
+}
+
+func (w *complexityWalker) fieldCost(parent graphql.Type, field string) int {
+	if parent != nil {
+		if cost, ok := w.limits.FieldCosts[parent.Name()+"."+field]; ok {
+			return cost
+		}
+	}
+	return 1
+}
+
+func fieldDefinitionForType(parent graphql.Type, name string) *graphql.FieldDefinition {
+	switch parent := parent.(type) {
+	case *graphql.Object:
+		return parent.Fields()[name]
+	case *graphql.Interface:
+		return parent.Fields()[name]
+	}
+	return nil
+}
+
+// unwrapType returns the named type that a type wraps, along with how
+// many lists it is wrapped in.
+func unwrapType(ttype graphql.Type) (graphql.Type, int) {
+	lists := 0
+	for {
+		switch t := ttype.(type) {
+		case *graphql.NonNull:
+			ttype = t.OfType
+		case *graphql.List:
+			lists++
+			ttype = t.OfType
+		default:
+			return ttype, lists
+		}
+	}
+}
+
+func (w *complexityWalker) selectionSet(
+	set *ast.SelectionSet,
+	parent graphql.Type,
+	visited map[string]bool,
+) queryComplexity {
+	complexity := queryComplexity{}
+	if set == nil {
+		return complexity
+	}
+
+	for _, selection := range set.Selections {
+		var child queryComplexity
+
+		switch selection := selection.(type) {
+		case *ast.Field:
+			name := selection.Name.Value
+
+			// Introspecting the type name is free
+			if name == "__typename" {
+				child.Depth = 1
+				break
+			}
+
+			var fieldType graphql.Type
+			if def := fieldDefinitionForType(parent, name); def != nil {
+				fieldType = def.Type
+			}
+
+			namedType, lists := unwrapType(fieldType)
+			nested := w.selectionSet(selection.SelectionSet, namedType, visited)
+
+			multiplier := w.limits.ListMultiplier
+			if multiplier <= 0 {
+				multiplier = 1
+			}
+			for i := 0; i < lists; i++ {
+				nested.Cost *= multiplier
+			}
+
+			child.Depth = nested.Depth + 1
+			child.Cost = w.fieldCost(parent, name) + nested.Cost
+
+		case *ast.FragmentSpread:
+			name := selection.Name.Value
+			fragment := w.fragments[name]
+			if fragment == nil || visited[name] {
+				continue
+			}
+			visited[name] = true
+			child = w.selectionSet(
+				fragment.SelectionSet,
+				w.typeCondition(fragment.TypeCondition, parent),
+				visited,
+			)
+			delete(visited, name)
+
+		case *ast.InlineFragment:
+			child = w.selectionSet(
+				selection.SelectionSet,
+				w.typeCondition(selection.TypeCondition, parent),
+				visited,
+			)
+		}
+
+		complexity.Cost += child.Cost
+		if child.Depth > complexity.Depth {
+			complexity.Depth = child.Depth
+		}
+	}
+
+	return complexity
+}
+
+func (w *complexityWalker) typeCondition(
+	condition *ast.Named,
+	parent graphql.Type,
+) graphql.Type {
+	if condition == nil || condition.Name == nil {
+		return parent
+	}
+	return w.schema.Type(condition.Name.Value)
+}
+
+// subscriptionComplexity computes the depth and cost of a subscription
+// operation in a document.
+func subscriptionComplexity(
+	schema *graphql.Schema,
+	doc *ast.Document,
+	def *ast.OperationDefinition,
+	limits ComplexityLimits,
+) queryComplexity {
+	if def.Operation != "subscription" {
+		return queryComplexity{}
+	}
+
+	walker := &complexityWalker{
+		schema:    schema,
+		fragments: fragmentDefinitionsForDocument(doc),
+		limits:    limits,
+	}
+
+	var root graphql.Type
+	if schema != nil && schema.SubscriptionType() != nil {
+		root = schema.SubscriptionType()
+	}
+	return walker.selectionSet(def.GetSelectionSet(), root, make(map[string]bool))
+}
+
+// validateComplexity returns GraphQL errors for every limit that a
+// query complexity exceeds.
+func validateComplexity(
+	complexity queryComplexity,
+	limits ComplexityLimits,
+) []error {
+	errs := []error{}
+
+	if limits.MaxDepth > 0 && complexity.Depth > limits.MaxDepth {
+		errs = append(errs, gqlerrors.NewFormattedError(fmt.Sprintf(
+			"Subscription query has depth %d, which exceeds the maximum depth of %d",
+			complexity.Depth,
+			limits.MaxDepth,
+		)))
+	}
+
+	if limits.MaxCost > 0 && complexity.Cost > limits.MaxCost {
+		errs = append(errs, gqlerrors.NewFormattedError(fmt.Sprintf(
+			"Subscription query has cost %d, which exceeds the maximum cost of %d",
+			complexity.Cost,
+			limits.MaxCost,
+		)))
+	}
+
+	return errs
+}
@@ -1,6 +1,7 @@
 package graphqlws
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +10,6 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -32,24 +32,64 @@ const (
 	writeTimeout = 10 * time.Second
 )
 
+// ErrConnectionTerminated is the reason for closing connections that
+// the client terminated with a connection_terminate message.
+var ErrConnectionTerminated = errors.New("Connection terminated by client")
+
 // InitMessagePayload defines the parameters of a connection
 // init message.
 type InitMessagePayload struct {
 	AuthToken string `json:"authToken"`
+
+	// SessionID identifies the session to resume, if sessions are
+	// enabled (see SessionConfig).
+	SessionID string `json:"sessionId,omitempty"`
 }
 
 // StartMessagePayload defines the parameters of an operation that
 // a client requests to be started.
 type StartMessagePayload struct {
+	ID            string                 `json:"id,omitempty"`
 	Query         string                 `json:"query"`
 	Variables     map[string]interface{} `json:"variables"`
 	OperationName string                 `json:"operationName"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
 }
 
 // DataMessagePayload defines the result data of an operation.
 type DataMessagePayload struct {
-	Data   interface{} `json:"data"`
-	Errors []error     `json:"errors"`
+	Data       interface{}            `json:"data"`
+	Errors     []error                `json:"errors"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+
+	// Encoded is the JSON encoding of the payload if it was encoded before
+	// (see Encode); it is sent as is instead of encoding the payload again.
+	Encoded json.RawMessage `json:"-"`
+}
+
+// Encode encodes the payload to JSON once, so that sending the same
+// payload to many connections doesn't encode it for each of them. The
+// payload must be encoded again if it is changed afterwards.
+func (payload *DataMessagePayload) Encode() error {
+	payload.Encoded = nil
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	payload.Encoded = encoded
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, using the encoding of the
+// payload if it was encoded before.
+func (payload DataMessagePayload) MarshalJSON() ([]byte, error) {
+	if payload.Encoded != nil {
+		return payload.Encoded, nil
+	}
+
+	// Encode the fields without calling MarshalJSON again
+	type fields DataMessagePayload
+	return json.Marshal(fields(payload))
 }
 
 // OperationMessage represents a GraphQL WebSocket message.
@@ -75,11 +115,31 @@ type AuthenticateFunc func(token string) (interface{}, error)
 // Event handlers allow other system components to react to events such
 // as the connection closing or an operation being started or stopped.
 type ConnectionEventHandlers struct {
+	// Init is called whenever the client initializes the connection,
+	// after the user has been authenticated and before the connection
+	// is acknowledged. Returning an error rejects the initialization
+	// with a connection error and closes the connection.
+	Init func(Connection) error
+
 	// Close is called whenever the connection is closed, regardless of
 	// whether this happens because of an error or a deliberate termination
 	// by the client.
 	Close func(Connection)
 
+	// Disconnect is called after Close with the reason the connection was
+	// closed for: the error reading from the client (e.g. a
+	// *websocket.CloseError), ErrConnectionTerminated, the error that
+	// Init rejected the connection with, or a *websocket.CloseError
+	// describing why the server closed the connection.
+	Disconnect func(Connection, error)
+
+	// AuthenticationFailed is called whenever authenticating the user
+	// fails, with the error returned by the AuthenticateFunc.
+	AuthenticationFailed func(Connection, error)
+
+	// Acknowledged is called after the connection has been acknowledged.
+	Acknowledged func(Connection)
+
 	// StartOperation is called whenever the client demands that a GraphQL
 	// operation be started (typically a subscription). Event handlers
 	// are expected to take the necessary steps to register the operation
@@ -98,6 +158,31 @@ type ConnectionEventHandlers struct {
 type ConnectionConfig struct {
 	Authenticate  AuthenticateFunc
 	EventHandlers ConnectionEventHandlers
+
+	// RateLimiter, if set, decides whether inbound messages are processed.
+	RateLimiter RateLimiter
+
+	// RateLimitAction defines what happens to messages and connections
+	// rejected by the RateLimiter.
+	RateLimitAction RateLimitAction
+
+	// Logger is used to log what the connection is doing. If nil,
+	// nothing is logged.
+	Logger Logger
+
+	// Metrics, if set, are reported what the connection is doing.
+	Metrics Metrics
+
+	// Context is the parent of the connection's context, typically
+	// carrying the trace context of the WebSocket upgrade request.
+	Context context.Context
+
+	// Tracer traces the connection and extracts trace context from
+	// connection_init payloads. If nil, nothing is traced.
+	Tracer Tracer
+
+	// WriteBatching configures writing queued messages in batches.
+	WriteBatching WriteBatching
 }
 
 // Connection is an interface to represent GraphQL WebSocket connections.
@@ -117,19 +202,67 @@ type Connection interface {
 	SendError(error)
 }
 
+// ContextConnection is implemented by connections that have a context,
+// like all connections created by this package.
+type ContextConnection interface {
+	Connection
+
+	// Context returns the context of the connection. It carries the trace
+	// context propagated by the client and is cancelled when the
+	// connection is closed.
+	Context() context.Context
+}
+
+// CompletingConnection is implemented by connections that can notify
+// clients of completed operations, like all connections created by this
+// package.
+type CompletingConnection interface {
+	Connection
+
+	// SendComplete notifies the client that an operation (typically a
+	// subscription) has completed and no more results will be sent.
+	SendComplete(string)
+}
+
+// contextForConnection returns the context of a connection, or the
+// background context if it doesn't have one.
+func contextForConnection(conn Connection) context.Context {
+	if c, ok := conn.(ContextConnection); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// sendComplete notifies the client of a connection that an operation
+// has completed, if the connection supports this.
+func sendComplete(conn Connection, opID string) {
+	if c, ok := conn.(CompletingConnection); ok {
+		c.SendComplete(opID)
+	}
+}
+
 /**
  * The default implementation of the Connection interface.
  */
 
 type connection struct {
 	id         string
-	ws         *websocket.Conn
+	transport  Transport
 	config     ConnectionConfig
-	logger     *log.Entry
+	logger     Logger
+	metrics    Metrics
+	tracer     Tracer
+	ctx        context.Context
+	cancel     context.CancelFunc
+	ctxMutex   *sync.Mutex
+	created    time.Time
 	outgoing   chan OperationMessage
 	user       interface{}
+	sessionID  string
 	closeMutex *sync.Mutex
 	closed     bool
+	reason     error
+	writeDone  chan bool
 }
 
 func operationMessageForType(messageType string) OperationMessage {
@@ -142,22 +275,52 @@ func operationMessageForType(messageType string) OperationMessage {
 // the GraphQL WebSocket protocol by managing its internal state and handling
 // the client-server communication.
 func NewConnection(ws *websocket.Conn, config ConnectionConfig) Connection {
+	return NewConnectionWithTransport(NewWebSocketTransport(ws), config)
+}
+
+// NewConnectionWithTransport establishes a GraphQL WebSocket connection
+// over a custom transport.
+func NewConnectionWithTransport(transport Transport, config ConnectionConfig) Connection {
+	conn := newConnection(transport, config)
+	conn.start()
+	return conn
+}
+
+func newConnection(transport Transport, config ConnectionConfig) *connection {
 	conn := new(connection)
 	conn.id = uuid.New().String()
-	conn.ws = ws
+	conn.transport = transport
 	conn.config = config
-	conn.logger = NewLogger("connection/" + conn.id)
+	conn.logger = loggerForComponent(config.Logger, "connection/"+conn.id)
+	conn.metrics = metricsOrDefault(config.Metrics)
+	conn.tracer = tracerOrDefault(config.Tracer)
 	conn.closed = false
 	conn.closeMutex = &sync.Mutex{}
 
 	conn.outgoing = make(chan OperationMessage)
+	if config.WriteBatching.enabled() {
+		conn.outgoing = make(chan OperationMessage, config.WriteBatching.MaxMessages)
+	}
+	conn.writeDone = make(chan bool)
+
+	ctx := config.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	conn.ctxMutex = &sync.Mutex{}
+
+	return conn
+}
+
+func (conn *connection) start() {
+	conn.created = time.Now()
+	conn.metrics.ConnectionOpened()
 
 	go conn.writeLoop()
 	go conn.readLoop()
 
 	conn.logger.Info("Created connection")
-
-	return conn
 }
 
 func (conn *connection) ID() string {
@@ -168,45 +331,84 @@ func (conn *connection) User() interface{} {
 	return conn.user
 }
 
+func (conn *connection) Context() context.Context {
+	conn.ctxMutex.Lock()
+	defer conn.ctxMutex.Unlock()
+	return conn.ctx
+}
+
 func (conn *connection) SendData(opID string, data *DataMessagePayload) {
 	msg := operationMessageForType(gqlData)
 	msg.ID = opID
 	msg.Payload = data
-	conn.closeMutex.Lock()
-	if !conn.closed {
-		conn.outgoing <- msg
-	}
-	conn.closeMutex.Unlock()
+	conn.send(msg)
 }
 
 func (conn *connection) SendError(err error) {
 	msg := operationMessageForType(gqlError)
 	msg.Payload = err.Error()
-	conn.closeMutex.Lock()
-	if !conn.closed {
-		conn.outgoing <- msg
-	}
-	conn.closeMutex.Unlock()
+	conn.send(msg)
+}
+
+func (conn *connection) SendComplete(opID string) {
+	msg := operationMessageForType(gqlComplete)
+	msg.ID = opID
+	conn.send(msg)
 }
 
 func (conn *connection) sendOperationErrors(opID string, errs []error) {
-	if conn.closed {
-		return
-	}
 	msg := operationMessageForType(gqlError)
 	msg.ID = opID
 	msg.Payload = errs
+	conn.send(msg)
+}
+
+// send queues a message to be sent to the client, unless the connection
+// has been closed already.
+func (conn *connection) send(msg OperationMessage) {
+	conn.closeMutex.Lock()
+	defer conn.closeMutex.Unlock()
+
+	if conn.closed {
+		conn.metrics.MessageDropped(msg.Type, DropReasonClosed)
+		return
+	}
+	conn.metrics.MessageQueued(msg.Type)
+
+	// Drop the message if the write loop has stopped (e.g. because
+	// writing failed) rather than waiting for it forever
+	select {
+	case conn.outgoing <- msg:
+	case <-conn.writeDone:
+		conn.metrics.MessageDropped(msg.Type, DropReasonWriteFailed)
+	}
+}
+
+// terminate closes the connection from the server side; the read loop
+// notices this and closes the connection cleanly.
+func (conn *connection) terminate(code int, reason string) {
+	conn.logger.WithFields(LogFields{
+		"reason": reason,
+	}).Info("Terminating connection")
+
+	// Remember why the connection was closed, as the read loop will
+	// only see that it can no longer read from the closed connection
 	conn.closeMutex.Lock()
-	if !conn.closed {
-		conn.outgoing <- msg
+	if !conn.closed && conn.reason == nil {
+		conn.reason = &websocket.CloseError{Code: code, Text: reason}
 	}
 	conn.closeMutex.Unlock()
+
+	conn.transport.Close(code, reason)
 }
 
-func (conn *connection) close() {
+func (conn *connection) close(reason error) {
 	// Close the write loop by closing the outgoing messages channels
 	conn.closeMutex.Lock()
 	conn.closed = true
+	if conn.reason == nil {
+		conn.reason = reason
+	}
 	close(conn.outgoing)
 	conn.closeMutex.Unlock()
 
@@ -214,15 +416,19 @@ func (conn *connection) close() {
 	if conn.config.EventHandlers.Close != nil {
 		conn.config.EventHandlers.Close(conn)
 	}
+	if conn.config.EventHandlers.Disconnect != nil {
+		conn.config.EventHandlers.Disconnect(conn, conn.reason)
+	}
+
+	// Cancel everything running on behalf of the connection
+	conn.cancel()
 
+	conn.metrics.ConnectionClosed(time.Since(conn.created))
 	conn.logger.Info("Closed connection")
 }
 
 func (conn *connection) writeLoop() {
-	// Close the WebSocket connection when leaving the write loop;
-	// this ensures the read loop is also terminated and the connection
-	// closed cleanly
-	defer conn.ws.Close()
+	defer conn.stopWriting()
 
 	for {
 		select {
@@ -234,30 +440,93 @@ func (conn *connection) writeLoop() {
 				return
 			}
 
-			conn.logger.WithFields(log.Fields{
-				"msg": msg.String(),
-			}).Debug("Send message")
-
-			conn.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			// Write the messages queued behind it along with it, if enabled
+			batch := []OperationMessage{msg}
+			if conn.config.WriteBatching.enabled() {
+				batch = conn.drain(batch)
+				if conn.config.WriteBatching.Coalesce {
+					batch = conn.coalesce(batch)
+				}
+			}
 
-			// Send the message to the client; if this times out, the WebSocket
-			// connection will be corrupt, hence we need to close the write loop
-			// and the connection immediately
-			if err := conn.ws.WriteJSON(msg); err != nil {
-				conn.logger.WithFields(log.Fields{
-					"err": err,
-				}).Warn("Sending message failed")
+			if !conn.write(batch) {
 				return
 			}
 		}
 	}
 }
 
-func (conn *connection) readLoop() {
-	// Close the WebSocket connection when leaving the read loop
-	defer conn.ws.Close()
+// stopWriting closes the transport when leaving the write loop; this
+// ensures the read loop is also terminated and the connection closed
+// cleanly. Messages still queued once writing has failed are dropped.
+func (conn *connection) stopWriting() {
+	close(conn.writeDone)
+	conn.transport.Close(websocket.CloseNormalClosure, "")
 
-	conn.ws.SetReadLimit(readLimit)
+	for msg := range conn.outgoing {
+		conn.metrics.MessageDropped(msg.Type, DropReasonWriteFailed)
+	}
+}
+
+// write encodes messages and writes them to the transport. It returns
+// false if writing fails.
+func (conn *connection) write(batch []OperationMessage) bool {
+	messages := make([]OperationMessage, 0, len(batch))
+	encoded := make([][]byte, 0, len(batch))
+	for _, msg := range batch {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			conn.logger.WithFields(LogFields{
+				"err": err,
+			}).Error("Encoding message failed")
+			conn.metrics.MessageDropped(msg.Type, DropReasonWriteFailed)
+			continue
+		}
+
+		conn.logger.WithFields(LogFields{
+			"msg": string(data),
+		}).Debug("Send message")
+		messages = append(messages, msg)
+		encoded = append(encoded, data)
+	}
+
+	// Send the messages to the client; if this fails (e.g. times out),
+	// the transport will be corrupt, hence we need to close the write
+	// loop and the connection immediately
+	start := time.Now()
+	failed := func(i int, err error) bool {
+		conn.logger.WithFields(LogFields{
+			"err": err,
+		}).Warn("Sending message failed")
+		for _, msg := range messages[i:] {
+			conn.metrics.MessageDropped(msg.Type, DropReasonWriteFailed)
+		}
+		return false
+	}
+
+	batchTransport, ok := conn.transport.(BatchTransport)
+	if ok && conn.config.WriteBatching.SingleFrame && len(encoded) > 1 {
+		if err := batchTransport.WriteMessages(encoded); err != nil {
+			return failed(0, err)
+		}
+	} else {
+		for i, data := range encoded {
+			if err := conn.transport.WriteMessage(data); err != nil {
+				return failed(i, err)
+			}
+		}
+	}
+
+	latency := time.Since(start)
+	for _, msg := range messages {
+		conn.metrics.MessageSent(msg.Type, latency)
+	}
+	return true
+}
+
+func (conn *connection) readLoop() {
+	// Close the transport when leaving the read loop
+	defer conn.transport.Close(websocket.CloseNormalClosure, "")
 
 	for {
 		// Read the next message received from the client
@@ -265,45 +534,60 @@ func (conn *connection) readLoop() {
 		msg := OperationMessage{
 			Payload: &rawPayload,
 		}
-		err := conn.ws.ReadJSON(&msg)
+		data, err := conn.transport.ReadMessage()
+		if err == nil {
+			err = json.Unmarshal(data, &msg)
+		}
 
 		// If this causes an error, close the connection and read loop immediately;
 		// see https://github.com/gorilla/websocket/blob/master/conn.go#L924 for
 		// more information on why this is necessary
 		if err != nil {
-			conn.logger.WithFields(log.Fields{
+			conn.logger.WithFields(LogFields{
 				"reason": err,
 			}).Warn("Closing connection")
-			conn.close()
+			conn.close(err)
 			return
 		}
 
-		conn.logger.WithFields(log.Fields{
+		conn.logger.WithFields(LogFields{
 			"id":   msg.ID,
 			"type": msg.Type,
 		}).Debug("Received message")
+		conn.metrics.MessageReceived(msg.Type)
+
+		// Drop messages exceeding the rate limit, closing the connection
+		// if this is what the rate limit demands
+		if conn.config.RateLimiter != nil && !conn.config.RateLimiter.Allow(conn) {
+			if conn.config.RateLimitAction == RateLimitClose {
+				conn.logger.Warn("Closing connection exceeding the rate limit")
+				conn.transport.Close(websocket.ClosePolicyViolation, ErrRateLimitExceeded.Error())
+				conn.close(&websocket.CloseError{
+					Code: websocket.ClosePolicyViolation,
+					Text: ErrRateLimitExceeded.Error(),
+				})
+				return
+			}
+
+			conn.logger.WithFields(LogFields{
+				"id":   msg.ID,
+				"type": msg.Type,
+			}).Warn("Dropping message exceeding the rate limit")
+			conn.metrics.MessageDropped(msg.Type, DropReasonRateLimit)
+			if msg.ID != "" {
+				conn.sendOperationErrors(msg.ID, []error{ErrRateLimitExceeded})
+			} else {
+				conn.SendError(ErrRateLimitExceeded)
+			}
+			continue
+		}
 
 		switch msg.Type {
 
 		// When the GraphQL WS connection is initiated, send an ACK back
 		case gqlConnectionInit:
-			data := InitMessagePayload{}
-			if err := json.Unmarshal(rawPayload, &data); err != nil {
-				conn.SendError(errors.New("Invalid GQL_CONNECTION_INIT payload"))
-			} else {
-				if conn.config.Authenticate != nil {
-					user, err := conn.config.Authenticate(data.AuthToken)
-					if err != nil {
-						msg := operationMessageForType(gqlConnectionError)
-						msg.Payload = fmt.Sprintf("Failed to authenticate user: %v", err)
-						conn.outgoing <- msg
-					} else {
-						conn.user = user
-						conn.outgoing <- operationMessageForType(gqlConnectionAck)
-					}
-				} else {
-					conn.outgoing <- operationMessageForType(gqlConnectionAck)
-				}
+			if !conn.initialize(rawPayload) {
+				return
 			}
 
 		// Let event handlers deal with starting operations
@@ -330,16 +614,81 @@ func (conn *connection) readLoop() {
 		// close the connection and close the read loop
 		case gqlConnectionTerminate:
 			conn.logger.Debug("Connection terminated by client")
-			conn.close()
+			conn.close(ErrConnectionTerminated)
 			return
 
 		// GraphQL WS protocol messages that are not handled represent
 		// a bug in our implementation; make this very obvious by logging
 		// an error
 		default:
-			conn.logger.WithFields(log.Fields{
+			conn.logger.WithFields(LogFields{
 				"msg": msg.String(),
 			}).Error("Unhandled message")
 		}
 	}
 }
+
+// initialize handles connection_init messages by authenticating the user
+// and acknowledging the connection. It returns false if the connection
+// was rejected and closed.
+func (conn *connection) initialize(rawPayload json.RawMessage) bool {
+	data := InitMessagePayload{}
+	if err := json.Unmarshal(rawPayload, &data); err != nil {
+		conn.SendError(errors.New("Invalid GQL_CONNECTION_INIT payload"))
+		return true
+	}
+
+	// Continue the trace passed in by the client, if any; operations
+	// started later on are traced as part of this trace as well
+	ctx := conn.tracer.Extract(conn.Context(), carrierForPayload(rawPayload))
+	conn.ctxMutex.Lock()
+	conn.ctx = ctx
+	conn.ctxMutex.Unlock()
+
+	_, span := conn.tracer.Start(ctx, "graphqlws.connection_init", SpanOptions{
+		Attributes: []SpanAttribute{{Key: connectionIDKey, Value: conn.id}},
+	})
+
+	if conn.config.Authenticate != nil {
+		user, err := conn.config.Authenticate(data.AuthToken)
+		if err != nil {
+			conn.metrics.AuthenticationFailed()
+			if conn.config.EventHandlers.AuthenticationFailed != nil {
+				conn.config.EventHandlers.AuthenticationFailed(conn, err)
+			}
+			msg := operationMessageForType(gqlConnectionError)
+			msg.Payload = fmt.Sprintf("Failed to authenticate user: %v", err)
+			conn.send(msg)
+			span.End(err)
+			return true
+		}
+		conn.user = user
+	}
+	conn.sessionID = data.SessionID
+
+	// Let event handlers reject the initialization
+	if conn.config.EventHandlers.Init != nil {
+		if err := conn.config.EventHandlers.Init(conn); err != nil {
+			conn.logger.WithFields(LogFields{
+				"reason": err,
+			}).Warn("Rejecting connection")
+			msg := operationMessageForType(gqlConnectionError)
+			msg.Payload = err.Error()
+			conn.send(msg)
+			span.End(err)
+
+			// Let the write loop send the error before closing
+			conn.close(err)
+			<-conn.writeDone
+			return false
+		}
+	}
+
+	conn.send(operationMessageForType(gqlConnectionAck))
+	span.End()
+
+	if conn.config.EventHandlers.Acknowledged != nil {
+		conn.config.EventHandlers.Acknowledged(conn)
+	}
+	return true
+}
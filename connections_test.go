@@ -0,0 +1,261 @@
+package graphqlws_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	graphqlwsprometheus "github.com/functionalfoundry/graphqlws/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// In-memory transport
+
+type pipeTransport struct {
+	incoming  chan []byte
+	outgoing  chan []byte
+	closed    chan bool
+	closeOnce *sync.Once
+}
+
+func newPipeTransport() *pipeTransport {
+	return &pipeTransport{
+		incoming:  make(chan []byte, 10),
+		outgoing:  make(chan []byte, 10),
+		closed:    make(chan bool),
+		closeOnce: &sync.Once{},
+	}
+}
+
+func (t *pipeTransport) ReadMessage() ([]byte, error) {
+	select {
+	case data := <-t.incoming:
+		return data, nil
+	case <-t.closed:
+		return nil, errors.New("Transport closed")
+	}
+}
+
+func (t *pipeTransport) WriteMessage(data []byte) error {
+	select {
+	case t.outgoing <- data:
+		return nil
+	case <-t.closed:
+		return errors.New("Transport closed")
+	}
+}
+
+func (t *pipeTransport) Close(code int, reason string) error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+func (t *pipeTransport) send(msg graphqlws.OperationMessage) {
+	data, _ := json.Marshal(msg)
+	t.incoming <- data
+}
+
+func (t *pipeTransport) receive() (graphqlws.OperationMessage, error) {
+	msg := graphqlws.OperationMessage{}
+	select {
+	case data := <-t.outgoing:
+		err := json.Unmarshal(data, &msg)
+		return msg, err
+	case <-time.After(time.Second):
+		return msg, errors.New("Timed out")
+	}
+}
+
+// batchPipeTransport is a pipeTransport that also writes batches of
+// messages in single frames
+type batchPipeTransport struct {
+	*pipeTransport
+}
+
+func (t batchPipeTransport) WriteMessages(messages [][]byte) error {
+	return t.WriteMessage(bytes.Join(messages, []byte{'\n'}))
+}
+
+// Tests
+
+func TestConnections_ProtocolRunsOverCustomTransports(t *testing.T) {
+	transport := newPipeTransport()
+	closed := make(chan error, 1)
+	graphqlws.NewConnectionWithTransport(transport, graphqlws.ConnectionConfig{
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		EventHandlers: graphqlws.ConnectionEventHandlers{
+			Disconnect: func(conn graphqlws.Connection, reason error) {
+				closed <- reason
+			},
+		},
+	})
+
+	transport.send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{AuthToken: "joe"},
+	})
+	if msg, err := transport.receive(); err != nil || msg.Type != "connection_ack" {
+		t.Fatal("Connection is not acknowledged:", msg, err)
+	}
+
+	transport.send(graphqlws.OperationMessage{Type: "connection_terminate"})
+	select {
+	case reason := <-closed:
+		if reason != graphqlws.ErrConnectionTerminated {
+			t.Error("Connection is closed for the wrong reason:", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Connection is not closed when terminated")
+	}
+
+	select {
+	case <-transport.closed:
+	case <-time.After(time.Second):
+		t.Error("Transport is not closed along with the connection")
+	}
+}
+
+func TestConnections_QueuedMessagesAreBatchedAndCoalesced(t *testing.T) {
+	// Writes block until the test receives them, so that messages queue up
+	transport := batchPipeTransport{&pipeTransport{
+		incoming:  make(chan []byte, 10),
+		outgoing:  make(chan []byte),
+		closed:    make(chan bool),
+		closeOnce: &sync.Once{},
+	}}
+	defer transport.Close(0, "")
+
+	queued := make(chan bool)
+	graphqlws.NewConnectionWithTransport(transport, graphqlws.ConnectionConfig{
+		WriteBatching: graphqlws.WriteBatching{
+			MaxMessages: 10,
+			SingleFrame: true,
+			Coalesce:    true,
+		},
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		EventHandlers: graphqlws.ConnectionEventHandlers{
+			Acknowledged: func(conn graphqlws.Connection) {
+				for i := 1; i <= 3; i++ {
+					conn.SendData("1", &graphqlws.DataMessagePayload{Data: i})
+				}
+				conn.SendData("2", &graphqlws.DataMessagePayload{Data: 1})
+				close(queued)
+			},
+		},
+	})
+
+	transport.send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{AuthToken: "joe"},
+	})
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("Connection is not acknowledged")
+	}
+
+	// Split the frames written into messages
+	messages := []graphqlws.OperationMessage{}
+	for len(messages) < 3 {
+		select {
+		case frame := <-transport.outgoing:
+			for _, data := range bytes.Split(frame, []byte{'\n'}) {
+				msg := graphqlws.OperationMessage{}
+				if err := json.Unmarshal(data, &msg); err != nil {
+					t.Fatal("Failed to decode message:", string(data), err)
+				}
+				messages = append(messages, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for messages:", messages)
+		}
+	}
+
+	if messages[0].Type != "connection_ack" {
+		t.Error("Connection is not acknowledged first:", messages[0])
+	}
+	for i, id := range []string{"1", "2"} {
+		msg := messages[i+1]
+		if msg.Type != "data" || msg.ID != id {
+			t.Fatalf("Expected data for operation %s, got %v", id, msg)
+		}
+	}
+	payload := messages[1].Payload.(map[string]interface{})
+	if payload["data"] != float64(3) {
+		t.Error("Data is not coalesced into the latest result:", payload)
+	}
+
+	select {
+	case frame := <-transport.outgoing:
+		t.Error("Unexpected frame written:", string(frame))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnections_MessagesQueuedWhenWritingFailsAreDropped(t *testing.T) {
+	// Writes block until the transport is closed, so that messages queue up
+	transport := &pipeTransport{
+		incoming:  make(chan []byte, 10),
+		outgoing:  make(chan []byte),
+		closed:    make(chan bool),
+		closeOnce: &sync.Once{},
+	}
+
+	metrics := graphqlwsprometheus.NewMetrics("")
+	queued := make(chan bool)
+	graphqlws.NewConnectionWithTransport(transport, graphqlws.ConnectionConfig{
+		WriteBatching: graphqlws.WriteBatching{MaxMessages: 10},
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		Metrics: metrics,
+		EventHandlers: graphqlws.ConnectionEventHandlers{
+			Acknowledged: func(conn graphqlws.Connection) {
+				// Let the write loop block on the acknowledgement first
+				time.Sleep(50 * time.Millisecond)
+				for i := 1; i <= 3; i++ {
+					conn.SendData("1", &graphqlws.DataMessagePayload{Data: i})
+				}
+				close(queued)
+			},
+		},
+	})
+
+	transport.send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{AuthToken: "joe"},
+	})
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("Connection is not acknowledged")
+	}
+	transport.Close(0, "")
+
+	// Every queued message is accounted for once writing has failed
+	expected := `
+# HELP graphqlws_send_queue_depth Number of messages waiting to be sent to clients.
+# TYPE graphqlws_send_queue_depth gauge
+graphqlws_send_queue_depth 0
+`
+	for i := 0; ; i++ {
+		err := testutil.CollectAndCompare(metrics, strings.NewReader(expected),
+			"graphqlws_send_queue_depth")
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Queued messages are not dropped:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
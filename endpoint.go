@@ -0,0 +1,220 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// ErrorFormatter formats errors before they are sent to clients, e.g. to
+// hide the details of internal errors. GraphQL errors are passed in as
+// gqlerrors.FormattedError, whose OriginalError returns the error that
+// caused them.
+type ErrorFormatter func(error) gqlerrors.FormattedError
+
+// ContextBuilder builds the context that operations of a user are
+// executed in, based on the context of the request or connection.
+type ContextBuilder func(ctx context.Context, user interface{}) context.Context
+
+// EndpointConfig stores the configuration of a GraphQL endpoint that
+// serves queries and mutations over HTTP and subscriptions over
+// WebSocket connections.
+type EndpointConfig struct {
+	// Schema is the GraphQL schema operations are executed against.
+	Schema *graphql.Schema
+
+	// RootValue is the root value of queries and mutations.
+	RootValue interface{}
+
+	// Authenticate resolves auth tokens into users, for both HTTP requests
+	// and WebSocket connections.
+	Authenticate AuthenticateFunc
+
+	// AuthToken extracts the token passed to Authenticate from HTTP
+	// requests. By default, the bearer token of the Authorization header
+	// is used. WebSocket clients send their token with connection_init.
+	AuthToken func(*http.Request) string
+
+	// Context builds the context operations are executed in. It is used
+	// for queries, mutations and (if the subscription manager is created
+	// by the endpoint) subscriptions.
+	Context ContextBuilder
+
+	// FormatError formats the errors of all operations.
+	FormatError ErrorFormatter
+
+	// Logger is used to log what the endpoint is doing. If nil, nothing
+	// is logged.
+	Logger Logger
+
+	// WebSocket configures the WebSocket handler. If its subscription
+	// manager is nil, one that executes subscriptions through their
+	// subscribe resolvers is created for the schema. Authenticate,
+	// FormatError and Logger are taken from the endpoint configuration
+	// unless set.
+	WebSocket HandlerConfig
+}
+
+// NewEndpoint creates a handler for a single GraphQL endpoint: requests
+// with a WebSocket upgrade are handed to a WebSocket handler (see
+// NewHandler), while GET and POST requests execute queries (and POST
+// requests mutations) as in GraphQL over HTTP. Subscriptions can only be
+// started over WebSocket connections.
+func NewEndpoint(config EndpointConfig) http.Handler {
+	logger := loggerForComponent(config.Logger, "endpoint")
+
+	wsConfig := config.WebSocket
+	if wsConfig.Authenticate == nil {
+		wsConfig.Authenticate = config.Authenticate
+	}
+	if wsConfig.FormatError == nil {
+		wsConfig.FormatError = config.FormatError
+	}
+	if wsConfig.Logger == nil {
+		wsConfig.Logger = config.Logger
+	}
+	if wsConfig.SubscriptionManager == nil {
+		managerConfig := SubscriptionManagerConfig{
+			Schema:        config.Schema,
+			ExecutionMode: ResolverExecution,
+			RootValue:     config.RootValue,
+			Logger:        wsConfig.Logger,
+			Metrics:       wsConfig.Metrics,
+			Tracer:        wsConfig.Tracer,
+		}
+		if config.Context != nil {
+			managerConfig.Context = func(conn Connection) context.Context {
+				return config.Context(contextForConnection(conn), conn.User())
+			}
+		}
+		wsConfig.SubscriptionManager = NewSubscriptionManagerWithConfig(managerConfig)
+	}
+	wsHandler := NewHandler(wsConfig)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			wsHandler.ServeHTTP(w, r)
+			return
+		}
+		serveOperation(config, logger, w, r)
+	})
+}
+
+// serveOperation executes a query or mutation sent over HTTP.
+func serveOperation(
+	config EndpointConfig,
+	logger Logger,
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeErrors(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	payload, err := startPayloadFromRequest(w, r)
+	if err != nil {
+		writeErrors(w, statusForRequestError(err), err)
+		return
+	}
+
+	// Authenticate the user
+	var user interface{}
+	if config.Authenticate != nil {
+		authToken := config.AuthToken
+		if authToken == nil {
+			authToken = authTokenFromRequest
+		}
+		user, err = config.Authenticate(authToken(r))
+		if err != nil {
+			logger.WithField("err", err).Warn("Failed to authenticate user")
+			writeErrors(w, http.StatusUnauthorized,
+				fmt.Errorf("Failed to authenticate user: %v", err))
+			return
+		}
+	}
+
+	// Parse and validate the operation
+	document, err := parser.Parse(parser.ParseParams{Source: payload.Query})
+	if err != nil {
+		writeResult(w, http.StatusBadRequest, config.FormatError, &graphql.Result{
+			Errors: gqlerrors.FormatErrors(err),
+		})
+		return
+	}
+	validation := graphql.ValidateDocument(config.Schema, document, nil)
+	if !validation.IsValid {
+		writeResult(w, http.StatusBadRequest, config.FormatError, &graphql.Result{
+			Errors: validation.Errors,
+		})
+		return
+	}
+
+	// Only run queries over GET, and no subscriptions at all
+	switch operationTypeForDocument(document, payload.OperationName) {
+	case "mutation":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeErrors(w, http.StatusMethodNotAllowed,
+				errors.New("Mutations require a POST request"))
+			return
+		}
+	case "subscription":
+		writeErrors(w, http.StatusBadRequest,
+			errors.New("Subscriptions require a WebSocket connection"))
+		return
+	}
+
+	ctx := r.Context()
+	if config.Context != nil {
+		ctx = config.Context(ctx, user)
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        *config.Schema,
+		Root:          config.RootValue,
+		AST:           document,
+		OperationName: payload.OperationName,
+		Args:          payload.Variables,
+		Context:       ctx,
+	})
+	writeResult(w, http.StatusOK, config.FormatError, result)
+}
+
+// writeResult responds to a request with the result of an operation.
+func writeResult(
+	w http.ResponseWriter,
+	status int,
+	format ErrorFormatter,
+	result *graphql.Result,
+) {
+	if format != nil {
+		for i, err := range result.Errors {
+			result.Errors[i] = format(err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// formatErrors formats the errors of an operation sent to a client.
+func formatErrors(format ErrorFormatter, errs []error) []error {
+	if format == nil || len(errs) == 0 {
+		return errs
+	}
+	formatted := make([]error, len(errs))
+	for i, err := range errs {
+		formatted[i] = format(err)
+	}
+	return formatted
+}
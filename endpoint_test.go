@@ -0,0 +1,151 @@
+package graphqlws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+type userContextKey struct{}
+
+func TestEndpoint_OperationsAreServedOverHTTPAndWebSocket(t *testing.T) {
+	user := func(p graphql.ResolveParams) (interface{}, error) {
+		return p.Context.Value(userContextKey{}), nil
+	}
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"me": &graphql.Field{Type: graphql.String, Resolve: user},
+				"secret": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return nil, errors.New("database password is hunter2")
+					},
+				},
+			},
+		}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Mutation",
+			Fields: graphql.Fields{
+				"me": &graphql.Field{Type: graphql.String, Resolve: user},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"me": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+					Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+						events := make(chan interface{}, 1)
+						events <- p.Context.Value(userContextKey{})
+						return events, nil
+					},
+				},
+			},
+		}),
+	})
+
+	server := httptest.NewServer(graphqlws.NewEndpoint(graphqlws.EndpointConfig{
+		Schema: &schema,
+		Authenticate: func(token string) (interface{}, error) {
+			if token == "" {
+				return nil, errors.New("No token")
+			}
+			return token, nil
+		},
+		Context: func(ctx context.Context, user interface{}) context.Context {
+			return context.WithValue(ctx, userContextKey{}, user)
+		},
+		FormatError: func(err error) gqlerrors.FormattedError {
+			if strings.Contains(err.Error(), "password") {
+				return gqlerrors.NewFormattedError("Internal error")
+			}
+			return gqlerrors.FormatError(err)
+		},
+	}))
+	defer server.Close()
+
+	do := func(method string, query string, token string) (int, map[string]interface{}) {
+		var req *http.Request
+		if method == http.MethodGet {
+			req, _ = http.NewRequest(method, server.URL+"?query="+url.QueryEscape(query), nil)
+		} else {
+			body, _ := json.Marshal(map[string]string{"query": query})
+			req, _ = http.NewRequest(method, server.URL, strings.NewReader(string(body)))
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Failed to send request:", err)
+		}
+		defer resp.Body.Close()
+		result := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	// Verify that queries and mutations are executed with the context
+	// built for the authenticated user
+	expected := map[string]interface{}{"me": "joe"}
+	if status, result := do(http.MethodGet, "{ me }", "joe"); status != http.StatusOK ||
+		!reflect.DeepEqual(result["data"], expected) {
+		t.Error("Queries are not executed over GET:", status, result)
+	}
+	if status, result := do(http.MethodPost, "mutation { me }", "joe"); status != http.StatusOK ||
+		!reflect.DeepEqual(result["data"], expected) {
+		t.Error("Mutations are not executed over POST:", status, result)
+	}
+
+	// Verify that invalid requests are rejected
+	if status, _ := do(http.MethodGet, "{ me }", ""); status != http.StatusUnauthorized {
+		t.Error("Unauthenticated requests are accepted:", status)
+	}
+	if status, _ := do(http.MethodGet, "mutation { me }", "joe"); status != http.StatusMethodNotAllowed {
+		t.Error("Mutations are executed over GET:", status)
+	}
+	if status, _ := do(http.MethodPost, "subscription { me }", "joe"); status != http.StatusBadRequest {
+		t.Error("Subscriptions are executed over HTTP:", status)
+	}
+	if status, _ := do(http.MethodPost, "{ unknown }", "joe"); status != http.StatusBadRequest {
+		t.Error("Invalid queries are executed:", status)
+	}
+	large := "{ me " + strings.Repeat(" ", 8192) + "}"
+	if status, _ := do(http.MethodPost, large, "joe"); status != http.StatusRequestEntityTooLarge {
+		t.Error("Request bodies are not limited:", status)
+	}
+
+	// Verify that errors are formatted
+	_, result := do(http.MethodPost, "{ secret }", "joe")
+	errs, _ := result["errors"].([]interface{})
+	if len(errs) != 1 || errs[0].(map[string]interface{})["message"] != "Internal error" {
+		t.Error("Errors are not formatted:", result)
+	}
+
+	// Verify that subscriptions are served over WebSocket connections
+	// sharing the authentication and context
+	client := graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "jane"})
+	client.Start("1", graphqlws.StartMessagePayload{Query: "subscription { me }"})
+	payload := client.ExpectData("1")
+	if !reflect.DeepEqual(payload.Data, map[string]interface{}{"me": "jane"}) {
+		t.Error("Subscriptions are not served over WebSocket connections:", payload)
+	}
+}
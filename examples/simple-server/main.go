@@ -29,10 +29,19 @@ func main() {
 		log.WithField("err", err).Panic("GraphQL schema is invalid")
 	}
 
+	// Log through logrus
+	logger := graphqlws.NewLogrusLogger(log.StandardLogger())
+
 	// Create subscription manager and GraphQL WS handler
-	subscriptionManager := graphqlws.NewSubscriptionManager(&schema)
+	subscriptionManager := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema: &schema,
+			Logger: logger,
+		},
+	)
 	websocketHandler := graphqlws.NewHandler(graphqlws.HandlerConfig{
 		SubscriptionManager: subscriptionManager,
+		Logger:              logger,
 		Authenticate: func(token string) (interface{}, error) {
 			return "Default user", nil
 		},
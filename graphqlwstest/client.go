@@ -0,0 +1,160 @@
+package graphqlwstest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// DefaultTimeout is how long clients wait for messages by default.
+const DefaultTimeout = time.Second
+
+// Client is a scripted graphql-ws client for testing handlers end to end.
+// Its methods fail the test immediately if the server doesn't behave as
+// expected.
+type Client struct {
+	// Timeout is how long the client waits for messages.
+	Timeout time.Duration
+
+	t  testing.TB
+	ws *websocket.Conn
+}
+
+// Dial connects a client to a test server running a graphqlws handler,
+// sending the given headers with the WebSocket upgrade request.
+func Dial(t testing.TB, server *httptest.Server, header http.Header) *Client {
+	t.Helper()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-ws"}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	ws, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", url, err)
+	}
+
+	return &Client{Timeout: DefaultTimeout, t: t, ws: ws}
+}
+
+// Close closes the client's connection without terminating it first.
+func (c *Client) Close() {
+	c.ws.Close()
+}
+
+// Send sends a message to the server.
+func (c *Client) Send(msg graphqlws.OperationMessage) {
+	c.t.Helper()
+
+	if err := c.ws.WriteJSON(msg); err != nil {
+		c.t.Fatalf("Failed to send message %s: %v", msg, err)
+	}
+}
+
+// Init initializes the connection with the given payload (e.g. a
+// graphqlws.InitMessagePayload) and expects it to be acknowledged.
+func (c *Client) Init(payload interface{}) {
+	c.t.Helper()
+
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	c.Send(graphqlws.OperationMessage{Type: "connection_init", Payload: payload})
+	c.Expect("connection_ack", "")
+}
+
+// Start starts an operation (typically a subscription).
+func (c *Client) Start(id string, payload graphqlws.StartMessagePayload) {
+	c.t.Helper()
+
+	c.Send(graphqlws.OperationMessage{ID: id, Type: "start", Payload: payload})
+}
+
+// Stop stops an operation started before.
+func (c *Client) Stop(id string) {
+	c.t.Helper()
+
+	c.Send(graphqlws.OperationMessage{ID: id, Type: "stop"})
+}
+
+// Terminate terminates the connection.
+func (c *Client) Terminate() {
+	c.t.Helper()
+
+	c.Send(graphqlws.OperationMessage{Type: "connection_terminate"})
+}
+
+// Receive waits for the next message from the server. The payload of
+// the message is left undecoded as a json.RawMessage.
+func (c *Client) Receive() graphqlws.OperationMessage {
+	c.t.Helper()
+
+	msg, err := c.receive()
+	if err != nil {
+		c.t.Fatalf("Failed to receive message: %v", err)
+	}
+	return msg
+}
+
+func (c *Client) receive() (graphqlws.OperationMessage, error) {
+	payload := json.RawMessage{}
+	msg := graphqlws.OperationMessage{Payload: &payload}
+	c.ws.SetReadDeadline(time.Now().Add(c.Timeout))
+	err := c.ws.ReadJSON(&msg)
+	msg.Payload = payload
+	return msg, err
+}
+
+// Expect waits for the next message from the server and fails unless it
+// has the given type and operation ID.
+func (c *Client) Expect(messageType string, id string) graphqlws.OperationMessage {
+	c.t.Helper()
+
+	msg := c.Receive()
+	if msg.Type != messageType || msg.ID != id {
+		c.t.Fatalf("Expected %q message for operation %q, got %s", messageType, id, msg)
+	}
+	return msg
+}
+
+// ExpectData waits for the next message from the server, fails unless it
+// is a data message for the given operation and decodes its payload.
+func (c *Client) ExpectData(id string) DataPayload {
+	c.t.Helper()
+
+	msg := c.Expect("data", id)
+	payload := DataPayload{}
+	if err := json.Unmarshal(msg.Payload.(json.RawMessage), &payload); err != nil {
+		c.t.Fatalf("Failed to decode data payload %s: %v", msg, err)
+	}
+	return payload
+}
+
+// ExpectClose waits for the server to close the connection and fails
+// unless it does so with the given WebSocket close code.
+func (c *Client) ExpectClose(code int) {
+	c.t.Helper()
+
+	for {
+		msg, err := c.receive()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, code) {
+			c.t.Fatalf("Expected connection to be closed with code %d, got %v (last message: %s)",
+				code, err, msg)
+		}
+		return
+	}
+}
+
+// DataPayload is the decoded payload of a data message.
+type DataPayload struct {
+	Data   interface{}                `json:"data"`
+	Errors []gqlerrors.FormattedError `json:"errors"`
+}
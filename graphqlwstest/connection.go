@@ -0,0 +1,111 @@
+// Package graphqlwstest provides utilities for testing code built on
+// graphqlws: a fake Connection that records the messages sent to it and
+// a scripted client for exercising handlers end to end.
+package graphqlwstest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+)
+
+// Connection is a fake graphqlws.Connection that records the messages
+// sent to it instead of sending them to a client.
+type Connection struct {
+	id       string
+	user     interface{}
+	ctx      context.Context
+	messages []graphqlws.OperationMessage
+	notify   chan bool
+	mutex    *sync.Mutex
+}
+
+// NewConnection creates a fake connection with the given ID, associated
+// with the given user (which may be nil).
+func NewConnection(id string, user interface{}) *Connection {
+	return &Connection{
+		id:     id,
+		user:   user,
+		ctx:    context.Background(),
+		notify: make(chan bool),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// ID returns the ID the connection was created with.
+func (c *Connection) ID() string {
+	return c.id
+}
+
+// User returns the user the connection was created with.
+func (c *Connection) User() interface{} {
+	return c.user
+}
+
+// Context returns the background context, as fake connections are
+// never closed.
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
+
+// SendData records a data message for the given operation.
+func (c *Connection) SendData(opID string, data *graphqlws.DataMessagePayload) {
+	c.record(graphqlws.OperationMessage{ID: opID, Type: "data", Payload: data})
+}
+
+// SendError records an error message for the connection.
+func (c *Connection) SendError(err error) {
+	c.record(graphqlws.OperationMessage{Type: "error", Payload: err.Error()})
+}
+
+// SendComplete records that the given operation has completed.
+func (c *Connection) SendComplete(opID string) {
+	c.record(graphqlws.OperationMessage{ID: opID, Type: "complete"})
+}
+
+func (c *Connection) record(msg graphqlws.OperationMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.messages = append(c.messages, msg)
+
+	// Wake up everyone waiting for messages
+	close(c.notify)
+	c.notify = make(chan bool)
+}
+
+// Messages returns all messages sent to the connection so far.
+func (c *Connection) Messages() []graphqlws.OperationMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]graphqlws.OperationMessage{}, c.messages...)
+}
+
+// WaitForMessages waits until at least n messages have been sent to the
+// connection and returns them. It returns false if this takes longer
+// than the given timeout.
+func (c *Connection) WaitForMessages(
+	n int,
+	timeout time.Duration,
+) ([]graphqlws.OperationMessage, bool) {
+	deadline := time.After(timeout)
+	for {
+		c.mutex.Lock()
+		messages := append([]graphqlws.OperationMessage{}, c.messages...)
+		notify := c.notify
+		c.mutex.Unlock()
+
+		if len(messages) >= n {
+			return messages, true
+		}
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return messages, false
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package graphqlwstest_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+)
+
+func newSchema() graphql.Schema {
+	users := &graphql.Field{
+		Type: graphql.NewList(graphql.String),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source, nil
+		},
+	}
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"users": users},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Subscription",
+			Fields: graphql.Fields{"users": users},
+		}),
+	})
+	return schema
+}
+
+func waitForSubscriptions(t *testing.T, sm graphqlws.SubscriptionManager, n int) {
+	for i := 0; len(sm.SubscriptionsForField("users", nil)) != n; i++ {
+		if i == 100 {
+			t.Fatalf("Expected %d subscriptions", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_SubscriptionsWorkEndToEnd(t *testing.T) {
+	schema := newSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+	}))
+	defer server.Close()
+
+	client := graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+
+	client.Init(nil)
+	client.Start("1", graphqlws.StartMessagePayload{Query: "subscription { users }"})
+	waitForSubscriptions(t, sm, 1)
+
+	sm.Publish(context.Background(), "users", []string{"jane", "joe"})
+	payload := client.ExpectData("1")
+	expected := map[string]interface{}{"users": []interface{}{"jane", "joe"}}
+	if !reflect.DeepEqual(payload.Data, expected) || len(payload.Errors) > 0 {
+		t.Error("Published event is not delivered:", payload)
+	}
+
+	client.Stop("1")
+	waitForSubscriptions(t, sm, 0)
+
+	client.Start("2", graphqlws.StartMessagePayload{Query: "subscription { unknown }"})
+	client.Expect("error", "2")
+
+	client.Terminate()
+	client.ExpectClose(websocket.CloseNormalClosure)
+}
+
+func TestConnection_RecordsSentMessages(t *testing.T) {
+	schema := newSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	conn := graphqlwstest.NewConnection("1", "joe")
+
+	errs := sm.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "1",
+		Query:      "subscription { users }",
+		Connection: conn,
+		SendData: func(data *graphqlws.DataMessagePayload) {
+			conn.SendData("1", data)
+		},
+	})
+	if len(errs) > 0 {
+		t.Fatal("Failed to add subscription:", errs)
+	}
+
+	go sm.Publish(context.Background(), "users", []string{"jane"})
+
+	messages, ok := conn.WaitForMessages(1, time.Second)
+	if !ok || messages[0].Type != "data" || messages[0].ID != "1" {
+		t.Fatal("Sent messages are not recorded:", messages)
+	}
+	data := messages[0].Payload.(*graphqlws.DataMessagePayload).Data
+	if !reflect.DeepEqual(data, map[string]interface{}{"users": []interface{}{"jane"}}) {
+		t.Error("Sent message has the wrong payload:", data)
+	}
+}
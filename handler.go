@@ -1,16 +1,90 @@
 package graphqlws
 
 import (
+	"context"
+	"errors"
 	"net/http"
 
 	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
 )
 
 // HandlerConfig stores the configuration of a GraphQL WebSocket handler.
 type HandlerConfig struct {
 	SubscriptionManager SubscriptionManager
 	Authenticate        AuthenticateFunc
+
+	// RateLimit limits the rate of inbound messages per connection,
+	// user and remote IP address.
+	RateLimit RateLimitConfig
+
+	// ConnectionLimits limits the number of open connections in total,
+	// per remote IP address and per user.
+	ConnectionLimits ConnectionLimits
+
+	// TrustedProxyHeader is the header that a trusted proxy in front of
+	// the handler records client IP addresses in (e.g. X-Forwarded-For).
+	// If empty, the remote address of requests is used.
+	TrustedProxyHeader string
+
+	// Logger is used to log what the handler and its connections are
+	// doing. If nil, nothing is logged.
+	Logger Logger
+
+	// Metrics, if set, are reported what the handler and its connections
+	// are doing.
+	Metrics Metrics
+
+	// Tracer traces connections and their operations, and extracts trace
+	// context from the headers of WebSocket upgrade requests and from
+	// connection_init payloads. If nil, nothing is traced.
+	Tracer Tracer
+
+	// Hooks are called at the stages of the connection lifecycle.
+	Hooks HandlerHooks
+
+	// Sessions lets the subscriptions of clients that present a session
+	// ID survive connection drops.
+	Sessions SessionConfig
+
+	// FormatError, if set, formats the errors of operations before they
+	// are sent to clients.
+	FormatError ErrorFormatter
+
+	// WriteBatching configures connections to write queued messages in
+	// batches.
+	WriteBatching WriteBatching
+}
+
+// HandlerHooks defines callbacks for the stages of the lifecycle of
+// connections, e.g. for audit logging or presence features. Hooks that
+// return errors can veto the respective stage. All hooks are optional.
+type HandlerHooks struct {
+	// Connect is called for every WebSocket upgrade request. Returning an
+	// error rejects the request with HTTP 403 Forbidden.
+	Connect func(*http.Request) error
+
+	// Ack is called when a client initializes a connection, after the
+	// user has been authenticated. Returning an error rejects the
+	// connection with a connection error and closes it.
+	Ack func(Connection) error
+
+	// AuthenticationFailed is called when authenticating a user fails.
+	AuthenticationFailed func(Connection, error)
+
+	// StartSubscription is called when a client starts a subscription,
+	// before it is added to the subscription manager. Returning an error
+	// rejects the subscription.
+	StartSubscription func(Connection, *Subscription) error
+
+	// StopSubscription is called once for every subscription started
+	// before, when the client stops it, the server completes it, the
+	// client disconnects with the subscription still active or the
+	// subscription manager rejects it after StartSubscription accepted it.
+	StopSubscription func(Connection, *Subscription)
+
+	// Disconnect is called when a connection is closed, with the reason
+	// it was closed for (see ConnectionEventHandlers.Disconnect).
+	Disconnect func(Connection, error)
 }
 
 // NewHandler creates a WebSocket handler for GraphQL WebSocket connections.
@@ -24,74 +98,293 @@ func NewHandler(config HandlerConfig) http.Handler {
 		Subprotocols: []string{"graphql-ws"},
 	}
 
-	logger := NewLogger("handler")
+	logger := loggerForComponent(config.Logger, "handler")
+	tracer := tracerOrDefault(config.Tracer)
+	hooks := config.Hooks
 	subscriptionManager := config.SubscriptionManager
 
-	// Create a map (used like a set) to manage client connections
-	var connections = make(map[Connection]bool)
+	// Create a registry to manage client connections
+	registry := newConnectionRegistry(config.ConnectionLimits)
+
+	// Create a registry to manage sessions, if enabled
+	var sessions *sessionRegistry
+	if config.Sessions.enabled() {
+		sessions = newSessionRegistry(
+			config.Sessions,
+			loggerForComponent(config.Logger, "sessions"),
+			metricsOrDefault(config.Metrics),
+		)
+	}
+
+	// Share rate limits between connections
+	var limits *rateLimits
+	if config.RateLimit.enabled() {
+		limits = newRateLimits(config.RateLimit)
+	}
 
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			ip := remoteIP(r, config.TrustedProxyHeader)
+
+			// Continue the trace passed in by the client, if any; the request
+			// context is not used as the connection outlives the request
+			ctx := tracer.Extract(context.Background(), headerCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, "graphqlws.upgrade", SpanOptions{
+				Server:     true,
+				Attributes: []SpanAttribute{{Key: clientAddressKey, Value: ip}},
+			})
+			var failure []error
+			defer func() { span.End(failure...) }()
+
+			// Let hooks reject the connection
+			if hooks.Connect != nil {
+				if err := hooks.Connect(r); err != nil {
+					logger.WithField("reason", err).Warn("Connection rejected")
+					failure = []error{err}
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+			}
+
+			// Reject the connection if it exceeds the connection limits
+			// (or make room for it by closing other connections; these no
+			// longer count towards the limits, so they are closed even if
+			// the connection cannot be established)
+			victims, ok := registry.admit(ip)
+			if !ok {
+				logger.WithField("ip", ip).Warn("Too many connections")
+				failure = []error{ErrTooManyConnections}
+				http.Error(w, ErrTooManyConnections.Error(), http.StatusTooManyRequests)
+				return
+			}
+
 			// Establish a WebSocket connection
 			var ws, err = upgrader.Upgrade(w, r, nil)
 
 			// Bail out if the WebSocket connection could not be established
 			if err != nil {
 				logger.Warn("Failed to establish WebSocket connection", err)
+				failure = []error{err}
+				registry.release(ip)
+				closeConnections(victims)
 				return
 			}
 
 			// Close the connection early if it doesn't implement the graphql-ws protocol
 			if ws.Subprotocol() != "graphql-ws" {
 				logger.Warn("Connection does not implement the GraphQL WS protocol")
+				failure = []error{errors.New("Unsupported subprotocol")}
+				registry.release(ip)
+				closeConnections(victims)
 				ws.Close()
 				return
 			}
 
+			closeConnections(victims)
+
+			// Rate-limit the connection's messages
+			var limiter RateLimiter
+			if limits != nil {
+				limiter = limits.limiterForConnection(ip)
+			}
+
+			// Keep track of the subscriptions started by the client and the
+			// session it resumed, if any; event handlers are all called from
+			// the connection's read loop
+			started := newStartedSubscriptions()
+			var resumed *session
+
+			// Subscriptions of sessions are registered with the session, so
+			// that they outlive the connection
+			subscriber := func(conn Connection) Connection {
+				if resumed != nil {
+					return resumed
+				}
+				return conn
+			}
+
 			// Establish a GraphQL WebSocket connection
-			conn := NewConnection(ws, ConnectionConfig{
-				Authenticate: config.Authenticate,
+			conn := newConnection(NewWebSocketTransport(ws), ConnectionConfig{
+				Authenticate:    config.Authenticate,
+				RateLimiter:     limiter,
+				RateLimitAction: config.RateLimit.Action,
+				Logger:          config.Logger,
+				Metrics:         config.Metrics,
+				Context:         ctx,
+				Tracer:          config.Tracer,
+				WriteBatching:   config.WriteBatching,
 				EventHandlers: ConnectionEventHandlers{
+					Init: func(conn Connection) error {
+						// Enforce the per-user connection limit
+						key, ok := keyForUser(config.ConnectionLimits.UserKey, conn.User())
+						if ok {
+							victims, ok := registry.authenticate(conn, key)
+							if !ok {
+								return ErrTooManyConnections
+							}
+							closeConnections(victims)
+						}
+
+						if hooks.Ack != nil {
+							if err := hooks.Ack(conn); err != nil {
+								return err
+							}
+						}
+
+						// Resume the client's session (or start a new one)
+						if id := sessionIDForConnection(conn); sessions != nil && id != "" {
+							s, err := sessions.claim(id, conn.(*connection))
+							if err != nil {
+								return err
+							}
+							resumed = s
+							started = s.started
+						}
+						return nil
+					},
+					Acknowledged: func(conn Connection) {
+						// Send the results buffered while the session was parked
+						if resumed != nil {
+							resumed.attach(conn.(*connection))
+						}
+					},
+					AuthenticationFailed: hooks.AuthenticationFailed,
 					Close: func(conn Connection) {
-						logger.WithFields(log.Fields{
+						logger.WithFields(LogFields{
 							"conn": conn.ID(),
 							"user": conn.User(),
 						}).Debug("Closing connection")
 
-						subscriptionManager.RemoveSubscriptions(conn)
+						registry.remove(conn)
+
+						// Park the subscriptions of sessions until the session
+						// is resumed or expires
+						if resumed != nil {
+							s := resumed
+							sessions.park(s, conn.(*connection), func() {
+								subscriptionManager.RemoveSubscriptions(s)
+								if hooks.StopSubscription != nil {
+									for _, subscription := range s.started.all() {
+										hooks.StopSubscription(s, subscription)
+									}
+								}
+							})
+							return
+						}
 
-						delete(connections, conn)
+						subscriptionManager.RemoveSubscriptions(conn)
+						if hooks.StopSubscription != nil {
+							for _, subscription := range started.all() {
+								hooks.StopSubscription(conn, subscription)
+							}
+						}
 					},
+					Disconnect: hooks.Disconnect,
 					StartOperation: func(
 						conn Connection,
 						opID string,
 						data *StartMessagePayload,
 					) []error {
-						logger.WithFields(log.Fields{
+						logger.WithFields(LogFields{
 							"conn": conn.ID(),
 							"op":   opID,
 							"user": conn.User(),
 						}).Debug("Start operation")
 
-						return subscriptionManager.AddSubscription(conn, &Subscription{
-							ID:            opID,
-							Query:         data.Query,
-							Variables:     data.Variables,
-							OperationName: data.OperationName,
-							Connection:    conn,
+						// Operations of resumed sessions are still active, so
+						// clients may restart them after reconnecting; starting
+						// a different operation with the same ID replaces it
+						if resumed != nil {
+							if previous := started.get(opID); previous != nil {
+								if restarts(previous, data) {
+									return nil
+								}
+								subscriptionManager.RemoveSubscription(resumed, previous)
+								started.remove(opID)
+								if hooks.StopSubscription != nil {
+									hooks.StopSubscription(conn, previous)
+								}
+							}
+						}
+
+						owner := subscriber(conn)
+						registered := started
+						var subscription *Subscription
+						subscription = &Subscription{
+							ID:               opID,
+							Query:            data.Query,
+							Variables:        data.Variables,
+							OperationName:    data.OperationName,
+							Extensions:       data.Extensions,
+							PersistedQueryID: data.ID,
+							Connection:       owner,
 							SendData: func(data *DataMessagePayload) {
-								conn.SendData(opID, data)
+								if config.FormatError != nil && len(data.Errors) > 0 {
+									formatted := *data
+									formatted.Errors = formatErrors(config.FormatError, data.Errors)
+									formatted.Encoded = nil
+									data = &formatted
+								}
+								owner.SendData(opID, data)
 							},
-						})
+							Complete: func() {
+								// Subscriptions completed by the server are
+								// stopped as if the client had stopped them
+								if registered.drop(subscription) && hooks.StopSubscription != nil {
+									hooks.StopSubscription(owner, subscription)
+								}
+							},
+						}
+
+						// Let hooks reject the subscription
+						if hooks.StartSubscription != nil {
+							if err := hooks.StartSubscription(conn, subscription); err != nil {
+								return formatErrors(config.FormatError, []error{err})
+							}
+						}
+
+						// Keep track of the subscription before adding it, as it
+						// may be completed right away (subscriptions with IDs in
+						// use are rejected by the subscription manager)
+						tracked := registered.track(subscription)
+						if errs := subscriptionManager.AddSubscription(owner, subscription); len(errs) > 0 {
+							if tracked {
+								registered.drop(subscription)
+							}
+
+							// Hooks that saw the subscription start must see it
+							// stop, too
+							if hooks.StopSubscription != nil {
+								hooks.StopSubscription(conn, subscription)
+							}
+							return formatErrors(config.FormatError, errs)
+						}
+						return nil
 					},
 					StopOperation: func(conn Connection, opID string) {
-						subscriptionManager.RemoveSubscription(conn, &Subscription{
+						subscriptionManager.RemoveSubscription(subscriber(conn), &Subscription{
 							ID: opID,
 						})
+
+						if subscription := started.remove(opID); subscription != nil {
+							if hooks.StopSubscription != nil {
+								hooks.StopSubscription(conn, subscription)
+							}
+						}
 					},
 				},
 			})
-			connections[conn] = true
+			span.SetAttributes(SpanAttribute{Key: connectionIDKey, Value: conn.ID()})
+			registry.add(conn, ip)
+			conn.start()
 		},
 	)
 }
+
+// closeConnections closes connections that had to make room for
+// others because of the connection limits.
+func closeConnections(conns []*connection) {
+	for _, conn := range conns {
+		conn.terminate(websocket.ClosePolicyViolation, ErrTooManyConnections.Error())
+	}
+}
@@ -0,0 +1,679 @@
+package graphqlws_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	graphqlwsprometheus "github.com/functionalfoundry/graphqlws/prometheus"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Test helpers
+
+func newTestSchema() graphql.Schema {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		})})
+	return schema
+}
+
+// waitForTestSubscriptions waits for the number of subscriptions to the
+// users field to reach n, as subscriptions are added asynchronously.
+func waitForTestSubscriptions(t *testing.T, sm graphqlws.SubscriptionManager, n int) {
+	t.Helper()
+
+	for i := 0; len(sm.SubscriptionsForField("users", nil)) != n; i++ {
+		if i == 200 {
+			t.Fatalf("Expected %d subscriptions", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests
+
+func TestHandler_MessagesExceedingTheRateLimitAreRejected(t *testing.T) {
+	schema := newTestSchema()
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		RateLimit: graphqlws.RateLimitConfig{
+			PerConnection: graphqlws.RateLimit{Rate: 0.001, Burst: 2},
+		},
+	}))
+	defer server.Close()
+
+	client := graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+	client.Init(nil)
+
+	client.Stop("1")
+	client.Stop("2")
+	client.Expect("error", "2")
+}
+
+func TestHandler_RejectedMessagesDontCountTowardsOtherRateLimits(t *testing.T) {
+	schema := newTestSchema()
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		RateLimit: graphqlws.RateLimitConfig{
+			PerConnection: graphqlws.RateLimit{Rate: 0.001, Burst: 3},
+			PerIP:         graphqlws.RateLimit{Rate: 10, Burst: 1},
+		},
+	}))
+	defer server.Close()
+
+	client := graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+	client.Init(nil)
+	time.Sleep(150 * time.Millisecond)
+
+	// Exceed the per-IP limit, which must not use up the connection's
+	// tokens, so that the third message is accepted once the IP limit
+	// allows it again
+	client.Stop("1")
+	client.Stop("2")
+	client.Expect("error", "2")
+	time.Sleep(150 * time.Millisecond)
+	client.Stop("3")
+	client.Stop("4")
+	client.Expect("error", "4")
+}
+
+func TestHandler_ConnectionsExceedingTheRateLimitAreClosed(t *testing.T) {
+	schema := newTestSchema()
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		RateLimit: graphqlws.RateLimitConfig{
+			PerIP:  graphqlws.RateLimit{Rate: 0.001, Burst: 1},
+			Action: graphqlws.RateLimitClose,
+		},
+	}))
+	defer server.Close()
+
+	client := graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+	client.Init(nil)
+
+	client.Stop("1")
+	client.ExpectClose(websocket.ClosePolicyViolation)
+}
+
+func TestHandler_ConnectionsExceedingTheIPLimitAreRejected(t *testing.T) {
+	schema := newTestSchema()
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		ConnectionLimits: graphqlws.ConnectionLimits{
+			MaxConnectionsPerIP: 1,
+		},
+		TrustedProxyHeader: "X-Forwarded-For",
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-ws"}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(ip string) (*websocket.Conn, *http.Response, error) {
+		return dialer.Dial(url, http.Header{"X-Forwarded-For": {"10.0.0.1, " + ip}})
+	}
+
+	client := graphqlwstest.Dial(t, server, http.Header{
+		"X-Forwarded-For": {"10.0.0.1, 192.168.0.1"},
+	})
+	defer client.Close()
+
+	// Verify that a second connection from the same IP is rejected
+	_, resp, err := dial("192.168.0.1")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Error("Connections exceeding the per-IP limit are not rejected:", err)
+	}
+
+	// Verify that connections from other IPs are accepted
+	graphqlwstest.Dial(t, server, http.Header{
+		"X-Forwarded-For": {"10.0.0.1, 192.168.0.2"},
+	}).Close()
+
+	// Verify that closing a connection frees up its slot
+	client.Close()
+	for i := 0; ; i++ {
+		ws, _, err := dial("192.168.0.1")
+		if err == nil {
+			ws.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal("Closed connections don't free up slots:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandler_ConnectionsEvictedForFailedUpgradesAreClosed(t *testing.T) {
+	schema := newTestSchema()
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		ConnectionLimits: graphqlws.ConnectionLimits{
+			MaxConnectionsPerIP: 1,
+			Policy:              graphqlws.CloseOldestConnections,
+		},
+	}))
+	defer server.Close()
+
+	client := graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+
+	// Make room for a connection whose upgrade then fails
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal("Failed to send a request to the test server:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Upgrade does not fail:", resp.Status)
+	}
+
+	// The connection that made room no longer counts towards the limit,
+	// so it must be closed
+	client.ExpectClose(websocket.ClosePolicyViolation)
+}
+
+func TestHandler_OldestConnectionsOfUsersAreClosed(t *testing.T) {
+	schema := newTestSchema()
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		ConnectionLimits: graphqlws.ConnectionLimits{
+			MaxConnectionsPerUser: 1,
+			Policy:                graphqlws.CloseOldestConnections,
+		},
+	}))
+	defer server.Close()
+
+	client1 := graphqlwstest.Dial(t, server, nil)
+	defer client1.Close()
+	client1.Init(graphqlws.InitMessagePayload{AuthToken: "joe"})
+
+	client2 := graphqlwstest.Dial(t, server, nil)
+	defer client2.Close()
+	client2.Init(graphqlws.InitMessagePayload{AuthToken: "joe"})
+
+	// Verify that the oldest connection of the user is closed
+	client1.ExpectClose(websocket.ClosePolicyViolation)
+}
+
+func TestHandler_ConnectionsExceedingTheUserLimitAreRejected(t *testing.T) {
+	schema := newTestSchema()
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		ConnectionLimits: graphqlws.ConnectionLimits{
+			MaxConnectionsPerUser: 1,
+		},
+	}))
+	defer server.Close()
+
+	client1 := graphqlwstest.Dial(t, server, nil)
+	defer client1.Close()
+	client1.Init(graphqlws.InitMessagePayload{AuthToken: "joe"})
+
+	// Verify that connections exceeding the per-user limit are rejected
+	client2 := graphqlwstest.Dial(t, server, nil)
+	defer client2.Close()
+	client2.Send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{AuthToken: "joe"},
+	})
+	client2.Expect("connection_error", "")
+
+	// Verify that connections of other users are accepted
+	client3 := graphqlwstest.Dial(t, server, nil)
+	defer client3.Close()
+	client3.Init(graphqlws.InitMessagePayload{AuthToken: "jane"})
+}
+
+func TestHandler_MetricsAreReported(t *testing.T) {
+	schema := newTestSchema()
+	metrics := graphqlwsprometheus.NewMetrics("")
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManagerWithConfig(
+			graphqlws.SubscriptionManagerConfig{
+				Schema:  &schema,
+				Metrics: metrics,
+			},
+		),
+		Authenticate: func(token string) (interface{}, error) {
+			if token == "" {
+				return nil, errors.New("No token")
+			}
+			return token, nil
+		},
+		Metrics: metrics,
+	}))
+	defer server.Close()
+
+	client := graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+
+	client.Send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{},
+	})
+	client.Expect("connection_error", "")
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "joe"})
+	client.Start("1", graphqlws.StartMessagePayload{Query: "subscription { users }"})
+
+	// The subscription is added asynchronously, so wait for it
+	expected := `
+# HELP graphqlws_subscriptions_active Number of active subscriptions by subscribed field.
+# TYPE graphqlws_subscriptions_active gauge
+graphqlws_subscriptions_active{field="users"} 1
+`
+	for i := 0; ; i++ {
+		err := testutil.CollectAndCompare(metrics, strings.NewReader(expected),
+			"graphqlws_subscriptions_active")
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Active subscriptions are not reported:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected = `
+# HELP graphqlws_authentication_failures_total Number of failed authentication attempts.
+# TYPE graphqlws_authentication_failures_total counter
+graphqlws_authentication_failures_total 1
+# HELP graphqlws_connections_open Number of open connections.
+# TYPE graphqlws_connections_open gauge
+graphqlws_connections_open 1
+# HELP graphqlws_messages_received_total Number of messages received from clients by type.
+# TYPE graphqlws_messages_received_total counter
+graphqlws_messages_received_total{type="connection_init"} 2
+graphqlws_messages_received_total{type="start"} 1
+# HELP graphqlws_messages_sent_total Number of messages sent to clients by type.
+# TYPE graphqlws_messages_sent_total counter
+graphqlws_messages_sent_total{type="connection_ack"} 1
+graphqlws_messages_sent_total{type="connection_error"} 1
+`
+	if err := testutil.CollectAndCompare(metrics, strings.NewReader(expected),
+		"graphqlws_authentication_failures_total",
+		"graphqlws_connections_open",
+		"graphqlws_messages_received_total",
+		"graphqlws_messages_sent_total",
+	); err != nil {
+		t.Error("Metrics are not reported correctly:", err)
+	}
+}
+
+func TestHandler_LifecycleHooksAreCalled(t *testing.T) {
+	schema := newTestSchema()
+	events := make(chan string, 10)
+	disconnected := make(chan error, 1)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(&schema),
+		Authenticate: func(token string) (interface{}, error) {
+			if token == "" {
+				return nil, errors.New("No token")
+			}
+			return token, nil
+		},
+		Hooks: graphqlws.HandlerHooks{
+			Connect: func(r *http.Request) error {
+				if r.Header.Get("X-Client") == "" {
+					return errors.New("Unknown client")
+				}
+				return nil
+			},
+			Ack: func(conn graphqlws.Connection) error {
+				if conn.User() == "banned" {
+					return errors.New("User is banned")
+				}
+				events <- "ack " + conn.User().(string)
+				return nil
+			},
+			AuthenticationFailed: func(conn graphqlws.Connection, err error) {
+				events <- "auth failed"
+			},
+			StartSubscription: func(conn graphqlws.Connection, s *graphqlws.Subscription) error {
+				if s.ID == "forbidden" {
+					return errors.New("Forbidden")
+				}
+				events <- "start " + s.ID
+				return nil
+			},
+			StopSubscription: func(conn graphqlws.Connection, s *graphqlws.Subscription) {
+				events <- "stop " + s.ID
+			},
+			Disconnect: func(conn graphqlws.Connection, reason error) {
+				disconnected <- reason
+			},
+		},
+	}))
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"graphql-ws"}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Verify that hooks can reject connections
+	if _, resp, err := dialer.Dial(url, nil); err == nil || resp == nil ||
+		resp.StatusCode != http.StatusForbidden {
+		t.Error("Connections rejected by hooks are accepted:", err)
+	}
+
+	header := http.Header{"X-Client": {"test"}}
+	client := graphqlwstest.Dial(t, server, header)
+	defer client.Close()
+
+	client.Send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{},
+	})
+	client.Expect("connection_error", "")
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "joe"})
+
+	query := graphqlws.StartMessagePayload{Query: "subscription { users }"}
+	client.Start("forbidden", query)
+	client.Expect("error", "forbidden")
+	client.Start("invalid", graphqlws.StartMessagePayload{Query: "subscription { nope }"})
+	client.Expect("error", "invalid")
+	client.Start("1", query)
+	client.Start("2", query)
+	client.Stop("1")
+	client.Terminate()
+
+	select {
+	case reason := <-disconnected:
+		if reason != graphqlws.ErrConnectionTerminated {
+			t.Error("Disconnect hook is called with the wrong reason:", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect hook is not called")
+	}
+
+	close(events)
+	got := []string{}
+	for event := range events {
+		got = append(got, event)
+	}
+	expected := "auth failed,ack joe,start invalid,stop invalid,start 1,start 2,stop 1,stop 2"
+	if strings.Join(got, ",") != expected {
+		t.Error("Hooks are not called as expected:", got)
+	}
+
+	// Verify that hooks can reject initialization
+	banned := graphqlwstest.Dial(t, server, header)
+	defer banned.Close()
+	banned.Send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{AuthToken: "banned"},
+	})
+	banned.Expect("connection_error", "")
+}
+
+func TestHandler_SessionsSurviveConnectionDrops(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	disconnected := make(chan error, 10)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		Sessions: graphqlws.SessionConfig{GracePeriod: 500 * time.Millisecond},
+		Hooks: graphqlws.HandlerHooks{
+			Disconnect: func(conn graphqlws.Connection, reason error) {
+				disconnected <- reason
+			},
+		},
+	}))
+	defer server.Close()
+
+	session := graphqlws.InitMessagePayload{AuthToken: "joe", SessionID: "session"}
+
+	client := graphqlwstest.Dial(t, server, nil)
+	client.Init(session)
+	client.Start("1", graphqlws.StartMessagePayload{Query: "subscription { users }"})
+	waitForTestSubscriptions(t, sm, 1)
+
+	// Drop the connection and publish an event while the session is parked
+	client.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Connection is not closed")
+	}
+	waitForTestSubscriptions(t, sm, 1)
+	sm.Publish(context.Background(), "users", nil)
+
+	// Verify that resuming the session delivers the buffered result and
+	// keeps the subscription active, even if the client restarts it
+	client = graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+	client.Init(session)
+	client.ExpectData("1")
+	client.Start("1", graphqlws.StartMessagePayload{Query: "subscription { users }"})
+	sm.Publish(context.Background(), "users", nil)
+	client.ExpectData("1")
+	waitForTestSubscriptions(t, sm, 1)
+
+	// Verify that restarting it with a different query replaces it
+	client.Start("1", graphqlws.StartMessagePayload{Query: "subscription Users { users }"})
+	for i := 0; ; i++ {
+		subscriptions := sm.SubscriptionsForField("users", nil)
+		if len(subscriptions) == 1 && subscriptions[0].Query == "subscription Users { users }" {
+			break
+		}
+		if i == 200 {
+			t.Fatal("Subscription is not replaced:", subscriptions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Verify that sessions cannot be resumed by other users
+	other := graphqlwstest.Dial(t, server, nil)
+	defer other.Close()
+	other.Send(graphqlws.OperationMessage{
+		Type:    "connection_init",
+		Payload: graphqlws.InitMessagePayload{AuthToken: "jane", SessionID: "session"},
+	})
+	other.Expect("connection_error", "")
+
+	// Verify that subscriptions are removed once the grace period expires
+	client.Close()
+	waitForTestSubscriptions(t, sm, 0)
+}
+
+func TestHandler_ResolverExecutionSurvivesConnectionDrops(t *testing.T) {
+	events := make(chan interface{})
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"counter": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+					Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+						return events, nil
+					},
+				},
+			},
+		})})
+
+	// Execute subscriptions in the context of their connection
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:        &schema,
+			ExecutionMode: graphqlws.ResolverExecution,
+			Context: func(conn graphqlws.Connection) context.Context {
+				return conn.(graphqlws.ContextConnection).Context()
+			},
+		},
+	)
+	disconnected := make(chan error, 10)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		Sessions: graphqlws.SessionConfig{GracePeriod: 500 * time.Millisecond},
+		Hooks: graphqlws.HandlerHooks{
+			Disconnect: func(conn graphqlws.Connection, reason error) {
+				disconnected <- reason
+			},
+		},
+	}))
+	defer server.Close()
+
+	publish := func(event interface{}) {
+		select {
+		case events <- event:
+		case <-time.After(time.Second):
+			t.Fatal("Source event stream is not consumed")
+		}
+	}
+	session := graphqlws.InitMessagePayload{AuthToken: "joe", SessionID: "session"}
+	query := graphqlws.StartMessagePayload{Query: "subscription { counter }"}
+
+	client := graphqlwstest.Dial(t, server, nil)
+	client.Init(session)
+	client.Start("1", query)
+	publish(1)
+	client.ExpectData("1")
+
+	// Verify that the source event stream isn't cancelled while the
+	// session is parked
+	client.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Connection is not closed")
+	}
+	publish(2)
+
+	// Verify that the resumed subscription still delivers events, even
+	// if the client restarts it
+	client = graphqlwstest.Dial(t, server, nil)
+	defer client.Close()
+	client.Init(session)
+	if payload := client.ExpectData("1"); payload.Data.(map[string]interface{})["counter"] != float64(2) {
+		t.Error("Event published while parked is not delivered:", payload)
+	}
+	client.Start("1", query)
+	publish(3)
+	if payload := client.ExpectData("1"); payload.Data.(map[string]interface{})["counter"] != float64(3) {
+		t.Error("Event published after resuming is not delivered:", payload)
+	}
+}
+
+func TestHandler_SubscriptionsCompletedByTheServerAreStopped(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"counter": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+					Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+						// Send a single event, then complete
+						events := make(chan interface{}, 1)
+						events <- 1
+						close(events)
+						return events, nil
+					},
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:        &schema,
+			ExecutionMode: graphqlws.ResolverExecution,
+		},
+	)
+	stopped := make(chan string, 10)
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		Sessions: graphqlws.SessionConfig{GracePeriod: 100 * time.Millisecond},
+		Hooks: graphqlws.HandlerHooks{
+			StopSubscription: func(conn graphqlws.Connection, subscription *graphqlws.Subscription) {
+				stopped <- subscription.ID
+			},
+		},
+	}))
+	defer server.Close()
+
+	client := graphqlwstest.Dial(t, server, nil)
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "joe", SessionID: "session"})
+
+	// Verify that completed subscriptions are stopped once and can be
+	// started again with the same ID
+	for i := 0; i < 2; i++ {
+		client.Start("1", graphqlws.StartMessagePayload{Query: "subscription { counter }"})
+		client.ExpectData("1")
+		client.Expect("complete", "1")
+		select {
+		case id := <-stopped:
+			if id != "1" {
+				t.Error("Wrong subscription is stopped:", id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Completed subscription is not stopped")
+		}
+	}
+
+	// Verify that they aren't stopped again when the session expires
+	client.Close()
+	select {
+	case id := <-stopped:
+		t.Error("Completed subscription is stopped twice:", id)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,163 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// subscriptionSet is a map (used like a set) of subscriptions.
+type subscriptionSet map[*Subscription]bool
+
+// fieldIndex keeps track of all subscriptions selecting a specific
+// top-level field, both as a whole and grouped by the values of the
+// arguments the field was selected with.
+type fieldIndex struct {
+	subscriptions subscriptionSet
+	arguments     map[string]map[string]subscriptionSet
+}
+
+func newFieldIndex() *fieldIndex {
+	return &fieldIndex{
+		subscriptions: make(subscriptionSet),
+		arguments:     make(map[string]map[string]subscriptionSet),
+	}
+}
+
+// subscriptionIndex maps top-level field names (and argument values)
+// to subscriptions, so that looking up the subscribers of a field
+// doesn't require scanning all connections and their subscriptions.
+type subscriptionIndex struct {
+	fields map[string]*fieldIndex
+}
+
+func newSubscriptionIndex() *subscriptionIndex {
+	return &subscriptionIndex{
+		fields: make(map[string]*fieldIndex),
+	}
+}
+
+// argumentKey returns a canonical representation of an argument value.
+// Values are compared by their JSON encoding, which makes e.g. numbers
+// from JSON variables (float64) match integer literals in queries.
+func argumentKey(value interface{}) (string, bool) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func (index *subscriptionIndex) add(subscription *Subscription) {
+	for _, field := range subscription.Selections {
+		entry := index.fields[field.Name]
+		if entry == nil {
+			entry = newFieldIndex()
+			index.fields[field.Name] = entry
+		}
+
+		entry.subscriptions[subscription] = true
+
+		for name, value := range field.Arguments {
+			key, ok := argumentKey(value)
+			if !ok {
+				continue
+			}
+			if entry.arguments[name] == nil {
+				entry.arguments[name] = make(map[string]subscriptionSet)
+			}
+			if entry.arguments[name][key] == nil {
+				entry.arguments[name][key] = make(subscriptionSet)
+			}
+			entry.arguments[name][key][subscription] = true
+		}
+	}
+}
+
+func (index *subscriptionIndex) remove(subscription *Subscription) {
+	for _, field := range subscription.Selections {
+		entry := index.fields[field.Name]
+		if entry == nil {
+			continue
+		}
+
+		delete(entry.subscriptions, subscription)
+
+		for name, value := range field.Arguments {
+			key, ok := argumentKey(value)
+			if !ok || entry.arguments[name] == nil {
+				continue
+			}
+			delete(entry.arguments[name][key], subscription)
+			if len(entry.arguments[name][key]) == 0 {
+				delete(entry.arguments[name], key)
+			}
+			if len(entry.arguments[name]) == 0 {
+				delete(entry.arguments, name)
+			}
+		}
+
+		// Remove the field altogether if nobody is subscribed to it anymore
+		if len(entry.subscriptions) == 0 {
+			delete(index.fields, field.Name)
+		}
+	}
+}
+
+// lookup returns all subscriptions that select the given field with
+// (at least) the given argument values.
+func (index *subscriptionIndex) lookup(
+	field string,
+	args map[string]interface{},
+) []*Subscription {
+	entry := index.fields[field]
+	if entry == nil {
+		return []*Subscription{}
+	}
+
+	// Without arguments, every subscription to the field matches
+	if len(args) == 0 {
+		out := make([]*Subscription, 0, len(entry.subscriptions))
+		for subscription := range entry.subscriptions {
+			out = append(out, subscription)
+		}
+		return out
+	}
+
+	// Otherwise, narrow the candidates down to the smallest set of
+	// subscriptions matching one of the arguments and check the
+	// remaining arguments for each of these candidates
+	keys := make(map[string]string, len(args))
+	var candidates subscriptionSet
+	for _, name := range sortedArgumentNames(args) {
+		key, ok := argumentKey(args[name])
+		if !ok {
+			return []*Subscription{}
+		}
+		keys[name] = key
+
+		set := entry.arguments[name][key]
+		if len(set) == 0 {
+			return []*Subscription{}
+		}
+		if candidates == nil || len(set) < len(candidates) {
+			candidates = set
+		}
+	}
+
+	out := []*Subscription{}
+	for subscription := range candidates {
+		if subscription.matchesArguments(field, keys) {
+			out = append(out, subscription)
+		}
+	}
+	return out
+}
+
+func sortedArgumentNames(args map[string]interface{}) []string {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,91 @@
+package graphqlws
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooManySubscriptions is returned when adding a subscription would
+// exceed one of the configured subscription limits.
+var ErrTooManySubscriptions = errors.New("Too many subscriptions")
+
+// UserKeyFunc is a function that maps the users returned from an
+// AuthenticateFunc to keys identifying them, for the purpose of
+// enforcing per-user limits.
+type UserKeyFunc func(user interface{}) string
+
+// keyForUser returns the key identifying a user, or false if there is
+// no user. Without a UserKeyFunc, users are identified by their default
+// string representation.
+func keyForUser(fn UserKeyFunc, user interface{}) (string, bool) {
+	if user == nil {
+		return "", false
+	}
+	if fn != nil {
+		key := fn(user)
+		return key, key != ""
+	}
+	return fmt.Sprint(user), true
+}
+
+// SubscriptionLimits defines how many subscriptions may be active at
+// the same time. A value of zero disables the respective limit.
+type SubscriptionLimits struct {
+	// MaxSubscriptions is the maximum number of subscriptions in total.
+	MaxSubscriptions int
+
+	// MaxSubscriptionsPerConnection is the maximum number of subscriptions
+	// of a single connection.
+	MaxSubscriptionsPerConnection int
+
+	// MaxSubscriptionsPerUser is the maximum number of subscriptions of
+	// a single user, across all of the user's connections.
+	MaxSubscriptionsPerUser int
+
+	// UserKey identifies users for the per-user limit.
+	UserKey UserKeyFunc
+}
+
+// ErrTooManyConnections is sent to clients whose connection would exceed
+// one of the configured connection limits.
+var ErrTooManyConnections = errors.New("Too many connections")
+
+// ConnectionLimitPolicy defines how connection limits are enforced.
+type ConnectionLimitPolicy int
+
+const (
+	// RejectNewConnections rejects connections exceeding a limit. Excess
+	// WebSocket upgrades are rejected with HTTP 429 Too Many Requests;
+	// connections exceeding the per-user limit are rejected with a
+	// connection error when the user is authenticated. This is the default.
+	RejectNewConnections ConnectionLimitPolicy = iota
+
+	// CloseOldestConnections accepts connections exceeding a limit and
+	// closes the oldest connection counting towards the limit instead.
+	CloseOldestConnections
+
+	// CloseNewestConnections accepts connections exceeding a limit and
+	// closes the most recent other connection counting towards the limit.
+	CloseNewestConnections
+)
+
+// ConnectionLimits defines how many connections may be open at the
+// same time. A value of zero disables the respective limit.
+type ConnectionLimits struct {
+	// MaxConnections is the maximum number of connections in total.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the maximum number of connections from a
+	// single remote IP address.
+	MaxConnectionsPerIP int
+
+	// MaxConnectionsPerUser is the maximum number of connections of a
+	// single authenticated user.
+	MaxConnectionsPerUser int
+
+	// UserKey identifies users for the per-user limit.
+	UserKey UserKeyFunc
+
+	// Policy defines how the limits are enforced.
+	Policy ConnectionLimitPolicy
+}
@@ -2,16 +2,129 @@ package graphqlws
 
 import (
 	"fmt"
+	"log/slog"
+	"sort"
 
 	log "github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
-// NewLogger returns a beautiful logger that logs messages with a
+// LogFields defines a set of fields attached to log messages.
+type LogFields map[string]interface{}
+
+// Logger is the interface that graphqlws logs through. Adapters for
+// logrus and log/slog are provided by NewLogrusLogger and NewSlogLogger;
+// nothing is logged unless a logger is configured.
+type Logger interface {
+	// WithField returns a logger that attaches a field to all messages.
+	WithField(key string, value interface{}) Logger
+
+	// WithFields returns a logger that attaches fields to all messages.
+	WithFields(fields LogFields) Logger
+
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// NewLogger returns a beautiful logrus logger that logs messages with a
 // given prefix (typically the name of a system component / subsystem).
+// Pass it to NewLogrusLogger to use it for graphqlws' own logs.
 func NewLogger(prefix string) *log.Entry {
 	logger := log.New()
 	logger.Formatter = new(prefixed.TextFormatter)
 	logger.Level = log.GetLevel()
 	return logger.WithField("prefix", fmt.Sprintf("graphqlws/%s", prefix))
 }
+
+// loggerForComponent returns a logger for a graphqlws component,
+// falling back to a no-op logger if none is configured.
+func loggerForComponent(logger Logger, component string) Logger {
+	if logger == nil {
+		return NewNopLogger()
+	}
+	return logger.WithField("prefix", fmt.Sprintf("graphqlws/%s", component))
+}
+
+/**
+ * Logger adapter for logrus.
+ */
+
+type logrusLogger struct {
+	logger log.FieldLogger
+}
+
+// NewLogrusLogger returns a Logger that logs through a logrus logger
+// (or entry).
+func NewLogrusLogger(logger log.FieldLogger) Logger {
+	return &logrusLogger{logger: logger}
+}
+
+func (l *logrusLogger) WithField(key string, value interface{}) Logger {
+	return &logrusLogger{logger: l.logger.WithField(key, value)}
+}
+
+func (l *logrusLogger) WithFields(fields LogFields) Logger {
+	return &logrusLogger{logger: l.logger.WithFields(log.Fields(fields))}
+}
+
+func (l *logrusLogger) Debug(args ...interface{}) { l.logger.Debug(args...) }
+func (l *logrusLogger) Info(args ...interface{})  { l.logger.Info(args...) }
+func (l *logrusLogger) Warn(args ...interface{})  { l.logger.Warn(args...) }
+func (l *logrusLogger) Error(args ...interface{}) { l.logger.Error(args...) }
+
+/**
+ * Logger adapter for log/slog.
+ */
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger that logs through a log/slog logger.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+func (l *slogLogger) WithField(key string, value interface{}) Logger {
+	return &slogLogger{logger: l.logger.With(key, value)}
+}
+
+func (l *slogLogger) WithFields(fields LogFields) Logger {
+	// Sort fields by key so that messages are logged consistently
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]interface{}, 0, 2*len(fields))
+	for _, key := range keys {
+		args = append(args, key, fields[key])
+	}
+	return &slogLogger{logger: l.logger.With(args...)}
+}
+
+func (l *slogLogger) Debug(args ...interface{}) { l.logger.Debug(fmt.Sprint(args...)) }
+func (l *slogLogger) Info(args ...interface{})  { l.logger.Info(fmt.Sprint(args...)) }
+func (l *slogLogger) Warn(args ...interface{})  { l.logger.Warn(fmt.Sprint(args...)) }
+func (l *slogLogger) Error(args ...interface{}) { l.logger.Error(fmt.Sprint(args...)) }
+
+/**
+ * No-op logger.
+ */
+
+type nopLogger struct{}
+
+// NewNopLogger returns a Logger that discards all messages.
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+func (l nopLogger) WithField(key string, value interface{}) Logger { return l }
+func (l nopLogger) WithFields(fields LogFields) Logger             { return l }
+func (l nopLogger) Debug(args ...interface{})                      {}
+func (l nopLogger) Info(args ...interface{})                       {}
+func (l nopLogger) Warn(args ...interface{})                       {}
+func (l nopLogger) Error(args ...interface{})                      {}
@@ -0,0 +1,95 @@
+package graphqlws
+
+import (
+	"time"
+)
+
+// Reasons for dropping messages, as reported to Metrics.MessageDropped.
+const (
+	// DropReasonClosed means that a message could not be sent because
+	// the connection was closed already.
+	DropReasonClosed = "closed"
+
+	// DropReasonRateLimit means that a message received from a client
+	// was dropped because it exceeded the rate limit.
+	DropReasonRateLimit = "rate_limit"
+
+	// DropReasonWriteFailed means that a queued message could not be
+	// written to the client.
+	DropReasonWriteFailed = "write_failed"
+
+	// DropReasonBufferFull means that a message for a parked session was
+	// dropped because the session's buffer was full.
+	DropReasonBufferFull = "buffer_full"
+
+	// DropReasonCoalesced means that a data message was dropped because
+	// a newer result for the same operation was queued (see WriteBatching).
+	DropReasonCoalesced = "coalesced"
+)
+
+// Metrics is the interface that graphqlws reports what connections and
+// subscriptions are doing to. The prometheus subpackage provides an
+// implementation; nothing is reported unless metrics are configured.
+type Metrics interface {
+	// ConnectionOpened is called when a connection is established.
+	ConnectionOpened()
+
+	// ConnectionClosed is called when a connection is closed, with the
+	// time the connection was open for.
+	ConnectionClosed(duration time.Duration)
+
+	// AuthenticationFailed is called when a client fails to authenticate.
+	AuthenticationFailed()
+
+	// SubscriptionAdded and SubscriptionRemoved are called for each of
+	// the fields selected by a subscription when it is added / removed.
+	SubscriptionAdded(field string)
+	SubscriptionRemoved(field string)
+
+	// MessageReceived is called for every message received from a client.
+	MessageReceived(messageType string)
+
+	// MessageQueued is called when a message is queued to be sent to a
+	// client. Every queued message is eventually reported as sent or as
+	// dropped with DropReasonWriteFailed or DropReasonCoalesced.
+	MessageQueued(messageType string)
+
+	// MessageSent is called when a message was written to a client, with
+	// the time that writing the message took.
+	MessageSent(messageType string, latency time.Duration)
+
+	// MessageDropped is called when a message is dropped instead of being
+	// sent or processed, with one of the DropReason constants.
+	MessageDropped(messageType string, reason string)
+
+	// ExecutionCompleted is called when a subscription has been executed
+	// for an event published for a field, or for an event of its source
+	// stream in ResolverExecution mode, with the time execution took.
+	ExecutionCompleted(field string, duration time.Duration)
+}
+
+// metricsOrDefault returns the configured metrics, falling back to
+// metrics that aren't reported anywhere.
+func metricsOrDefault(metrics Metrics) Metrics {
+	if metrics == nil {
+		return nopMetrics{}
+	}
+	return metrics
+}
+
+/**
+ * No-op metrics.
+ */
+
+type nopMetrics struct{}
+
+func (nopMetrics) ConnectionOpened()                        {}
+func (nopMetrics) ConnectionClosed(time.Duration)           {}
+func (nopMetrics) AuthenticationFailed()                    {}
+func (nopMetrics) SubscriptionAdded(string)                 {}
+func (nopMetrics) SubscriptionRemoved(string)               {}
+func (nopMetrics) MessageReceived(string)                   {}
+func (nopMetrics) MessageQueued(string)                     {}
+func (nopMetrics) MessageSent(string, time.Duration)        {}
+func (nopMetrics) MessageDropped(string, string)            {}
+func (nopMetrics) ExecutionCompleted(string, time.Duration) {}
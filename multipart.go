@@ -0,0 +1,77 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// multipartBoundary separates the parts of multipart responses.
+const multipartBoundary = "graphql"
+
+// NewMultipartHandler creates a handler that serves subscriptions over
+// multipart/mixed HTTP responses, as consumed by Apollo Client and urql.
+// Each POST request with a JSON body shaped like a StartMessagePayload
+// starts a subscription and receives its results as JSON parts in the
+// format of Apollo's multipart subscription protocol, i.e. wrapped as
+// `{"payload": ...}`, with empty `{}` parts as heartbeats. The response
+// ends when the subscription completes; the subscription is stopped when
+// the client goes away.
+//
+// Like NewSSEHandler, the handler adds subscriptions to the same
+// SubscriptionManager as the WebSocket handler.
+func NewMultipartHandler(config StreamHandlerConfig) http.Handler {
+	logger := loggerForComponent(config.Logger, "multipart")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeErrors(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+			return
+		}
+		serveStream(config, multipartFormat{}, logger, w, r)
+	})
+}
+
+// multipartFormat writes subscription results as the JSON parts of a
+// multipart/mixed response.
+type multipartFormat struct{}
+
+// multipartPayload wraps subscription results in parts.
+type multipartPayload struct {
+	Payload executionResult `json:"payload"`
+}
+
+func (multipartFormat) start(w http.ResponseWriter) {
+	w.Header().Set("Content-Type",
+		`multipart/mixed; boundary="`+multipartBoundary+`"; subscriptionSpec=1.0`)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "\r\n--"+multipartBoundary)
+}
+
+func (format multipartFormat) next(w http.ResponseWriter, result executionResult) error {
+	return format.part(w, multipartPayload{Payload: result})
+}
+
+func (multipartFormat) complete(w http.ResponseWriter) error {
+	_, err := fmt.Fprint(w, "--\r\n")
+	return err
+}
+
+func (format multipartFormat) keepAlive(w http.ResponseWriter) error {
+	return format.part(w, struct{}{})
+}
+
+// part writes a JSON part followed by the boundary.
+func (multipartFormat) part(w http.ResponseWriter, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w,
+		"\r\nContent-Type: application/json; charset=utf-8\r\n\r\n%s\r\n--%s",
+		data, multipartBoundary)
+	return err
+}
@@ -0,0 +1,103 @@
+// Package otel traces what graphqlws handlers, connections and
+// subscription managers are doing with OpenTelemetry, by implementing
+// graphqlws.Tracer. It is kept out of the graphqlws package so that only
+// applications using it depend on OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	"github.com/functionalfoundry/graphqlws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/functionalfoundry/graphqlws"
+
+// Tracer implements graphqlws.Tracer by starting OpenTelemetry spans.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewTracer creates a tracer that starts spans with the given tracer
+// provider and extracts trace context propagated by clients with the
+// given propagator. If either is nil, the global one is used.
+func NewTracer(
+	provider trace.TracerProvider,
+	propagator propagation.TextMapPropagator,
+) *Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+	return &Tracer{
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagator,
+	}
+}
+
+// Extract returns a context carrying the trace context found in the
+// carrier by the tracer's propagator.
+func (t *Tracer) Extract(
+	ctx context.Context,
+	carrier graphqlws.TraceCarrier,
+) context.Context {
+	return t.propagator.Extract(ctx, carrier)
+}
+
+// Start starts an OpenTelemetry span as part of the trace in the context.
+func (t *Tracer) Start(
+	ctx context.Context,
+	name string,
+	options graphqlws.SpanOptions,
+) (context.Context, graphqlws.Span) {
+	startOptions := []trace.SpanStartOption{
+		trace.WithAttributes(attributes(options.Attributes)...),
+	}
+	if options.Server {
+		startOptions = append(startOptions, trace.WithSpanKind(trace.SpanKindServer))
+	}
+	if link, ok := options.Link.(*span); ok {
+		startOptions = append(startOptions,
+			trace.WithLinks(trace.Link{SpanContext: link.span.SpanContext()}))
+	}
+
+	ctx, s := t.tracer.Start(ctx, name, startOptions...)
+	return ctx, &span{span: s}
+}
+
+type span struct {
+	span trace.Span
+}
+
+func (s *span) SetAttributes(attrs ...graphqlws.SpanAttribute) {
+	s.span.SetAttributes(attributes(attrs)...)
+}
+
+func (s *span) AddEvent(name string) {
+	s.span.AddEvent(name)
+}
+
+func (s *span) End(errs ...error) {
+	for _, err := range errs {
+		s.span.RecordError(err)
+	}
+	if len(errs) > 0 {
+		s.span.SetStatus(codes.Error, errs[0].Error())
+	}
+	s.span.End()
+}
+
+func attributes(attrs []graphqlws.SpanAttribute) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		kvs = append(kvs, attribute.String(attr.Key, attr.Value))
+	}
+	return kvs
+}
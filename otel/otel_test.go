@@ -0,0 +1,104 @@
+package otel_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	graphqlwsotel "github.com/functionalfoundry/graphqlws/otel"
+	"github.com/graphql-go/graphql"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracer_ConnectionsAndSubscriptionsAreTraced(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{Type: graphql.NewList(graphql.String)},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{Type: graphql.NewList(graphql.String)},
+			},
+		}),
+	})
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer := graphqlwsotel.NewTracer(provider, propagation.TraceContext{})
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema: &schema,
+		Tracer: tracer,
+	})
+	server := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: sm,
+		Tracer:              tracer,
+	}))
+	defer server.Close()
+
+	headerTrace := "0af7651916cd43dd8448eb211c80319c"
+	payloadTrace := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	client := graphqlwstest.Dial(t, server, http.Header{
+		"Traceparent": {"00-" + headerTrace + "-b7ad6b7169203331-01"},
+	})
+	defer client.Close()
+
+	client.Init(map[string]interface{}{
+		"traceparent": "00-" + payloadTrace + "-00f067aa0ba902b7-01",
+	})
+	client.Start("1", graphqlws.StartMessagePayload{Query: "subscription { users }"})
+
+	for i := 0; len(sm.SubscriptionsForField("users", nil)) != 1; i++ {
+		if i == 200 {
+			t.Fatal("Expected 1 subscription")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sm.Publish(context.Background(), "users", []string{"jane"})
+	client.ExpectData("1")
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	if span := spans["graphqlws.upgrade"]; span == nil ||
+		span.SpanContext().TraceID().String() != headerTrace {
+		t.Error("Upgrade is not traced as part of the trace from the headers:", span)
+	}
+	if span := spans["graphqlws.connection_init"]; span == nil ||
+		span.SpanContext().TraceID().String() != payloadTrace {
+		t.Error("Initialization is not traced as part of the trace from the payload:", span)
+	}
+	start := spans["graphqlws.start"]
+	if start == nil || start.SpanContext().TraceID().String() != payloadTrace {
+		t.Fatal("Start is not traced as part of the trace from the payload:", start)
+	}
+	hasAttribute := func(span sdktrace.ReadOnlySpan, key, value string) bool {
+		for _, attr := range span.Attributes() {
+			if string(attr.Key) == key && attr.Value.Emit() == value {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasAttribute(start, "graphqlws.subscription.id", "1") {
+		t.Error("Start span lacks the subscription ID:", start.Attributes())
+	}
+	execute := spans["graphqlws.execute"]
+	if execute == nil || len(execute.Links()) != 1 ||
+		execute.Links()[0].SpanContext.SpanID() != start.SpanContext().SpanID() {
+		t.Error("Execution is not traced and linked to the start:", execute)
+	} else if !hasAttribute(execute, "graphqlws.field", "users") {
+		t.Error("Execution span lacks the field:", execute.Attributes())
+	}
+}
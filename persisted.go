@@ -0,0 +1,121 @@
+package graphqlws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// PersistedQueryStore resolves persisted query IDs into query strings.
+type PersistedQueryStore interface {
+	// Get returns the query persisted under the given ID, along with
+	// whether such a query exists.
+	Get(id string) (string, bool)
+}
+
+// AutomaticPersistedQueryStore is a PersistedQueryStore that clients can
+// register queries with, by sending a query along with its ID as in
+// Apollo's automatic persisted queries.
+type AutomaticPersistedQueryStore interface {
+	PersistedQueryStore
+
+	// Register persists a query under the given ID.
+	Register(id string, query string)
+}
+
+// PersistedQueries is a simple, in-memory PersistedQueryStore mapping
+// persisted query IDs to queries.
+type PersistedQueries map[string]string
+
+// NewPersistedQueries creates a PersistedQueries store that persists
+// each of the given queries under its SHA-256 hash, as used by Apollo's
+// persisted queries.
+func NewPersistedQueries(queries ...string) PersistedQueries {
+	store := make(PersistedQueries, len(queries))
+	for _, query := range queries {
+		store[PersistedQueryID(query)] = query
+	}
+	return store
+}
+
+// Get returns the query persisted under the given ID.
+func (store PersistedQueries) Get(id string) (string, bool) {
+	query, ok := store[id]
+	return query, ok
+}
+
+// PersistedQueryID returns the ID of a query in Apollo's persisted
+// queries format, which is the hex-encoded SHA-256 hash of the query.
+func PersistedQueryID(query string) string {
+	hash := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(hash[:])
+}
+
+// persistedQueryIDFromExtensions extracts the persisted query ID from
+// extensions in Apollo's format, i.e.
+// `{"persistedQuery": {"version": 1, "sha256Hash": "<id>"}}`.
+func persistedQueryIDFromExtensions(extensions map[string]interface{}) string {
+	persistedQuery, ok := extensions["persistedQuery"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	id, _ := persistedQuery["sha256Hash"].(string)
+	return id
+}
+
+// resolvePersistedQuery replaces the query of a subscription with the
+// persisted query it refers to, if any, and enforces the allowlist if
+// only persisted queries are allowed.
+func resolvePersistedQuery(
+	s *Subscription,
+	store PersistedQueryStore,
+	allowlist bool,
+) []error {
+	id := s.PersistedQueryID
+	if id == "" {
+		id = persistedQueryIDFromExtensions(s.Extensions)
+
+		// Clients sending the query along with its hash (after it wasn't
+		// found) register it, unless only persisted queries are allowed
+		if id != "" && s.Query != "" && !allowlist {
+			if PersistedQueryID(s.Query) != id {
+				return []error{errors.New("provided sha does not match query")}
+			}
+			if registry, ok := store.(AutomaticPersistedQueryStore); ok {
+				registry.Register(id, s.Query)
+			}
+			s.PersistedQueryID = id
+			return nil
+		}
+	}
+
+	// Subscriptions referring to a persisted query get the persisted
+	// query string; errors use the messages clients like Apollo expect
+	if id != "" {
+		if store == nil {
+			return []error{errors.New("PersistedQueryNotSupported")}
+		}
+
+		query, ok := store.Get(id)
+		if !ok {
+			return []error{errors.New("PersistedQueryNotFound")}
+		}
+
+		s.PersistedQueryID = id
+		s.Query = query
+		return nil
+	}
+
+	// Subscriptions with plain queries are only allowed if the query
+	// is in the store as well
+	if allowlist && s.Query != "" {
+		if store == nil {
+			return []error{errors.New("Subscription query is not allowed")}
+		}
+		if _, ok := store.Get(PersistedQueryID(s.Query)); !ok {
+			return []error{errors.New("Subscription query is not allowed")}
+		}
+	}
+
+	return nil
+}
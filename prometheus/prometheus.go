@@ -0,0 +1,183 @@
+// Package prometheus reports what graphqlws handlers, connections and
+// subscription managers are doing as Prometheus metrics, by implementing
+// graphqlws.Metrics. It is kept out of the graphqlws package so that only
+// applications using it depend on the Prometheus client.
+package prometheus
+
+import (
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements graphqlws.Metrics by collecting Prometheus metrics.
+// It is a prometheus.Collector and needs to be registered with a
+// Prometheus registry to be exported.
+type Metrics struct {
+	connectionsOpen       prometheus.Gauge
+	connectionDuration    prometheus.Histogram
+	authenticationFailure prometheus.Counter
+	subscriptionsActive   *prometheus.GaugeVec
+	messagesReceived      *prometheus.CounterVec
+	messagesSent          *prometheus.CounterVec
+	messagesDropped       *prometheus.CounterVec
+	sendQueueDepth        prometheus.Gauge
+	writeDuration         prometheus.Histogram
+	executionDuration     *prometheus.HistogramVec
+}
+
+// NewMetrics creates Prometheus metrics with names prefixed by the given
+// namespace (or "graphqlws" if it is empty).
+func NewMetrics(namespace string) *Metrics {
+	if namespace == "" {
+		namespace = "graphqlws"
+	}
+
+	return &Metrics{
+		connectionsOpen: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connections_open",
+			Help:      "Number of open connections.",
+		}),
+		connectionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "connection_duration_seconds",
+			Help:      "Time connections were open for.",
+			Buckets:   []float64{1, 10, 60, 300, 1800, 3600, 14400, 86400},
+		}),
+		authenticationFailure: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "authentication_failures_total",
+			Help:      "Number of failed authentication attempts.",
+		}),
+		subscriptionsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "subscriptions_active",
+			Help:      "Number of active subscriptions by subscribed field.",
+		}, []string{"field"}),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_received_total",
+			Help:      "Number of messages received from clients by type.",
+		}, []string{"type"}),
+		messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_sent_total",
+			Help:      "Number of messages sent to clients by type.",
+		}, []string{"type"}),
+		messagesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_dropped_total",
+			Help:      "Number of messages dropped by type and reason.",
+		}, []string{"type", "reason"}),
+		sendQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "send_queue_depth",
+			Help:      "Number of messages waiting to be sent to clients.",
+		}),
+		writeDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "write_duration_seconds",
+			Help:      "Time taken to write messages to clients.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 9),
+		}),
+		executionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "execution_duration_seconds",
+			Help:      "Time taken to execute subscriptions for events by field.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 9),
+		}, []string{"field"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.connectionsOpen,
+		m.connectionDuration,
+		m.authenticationFailure,
+		m.subscriptionsActive,
+		m.messagesReceived,
+		m.messagesSent,
+		m.messagesDropped,
+		m.sendQueueDepth,
+		m.writeDuration,
+		m.executionDuration,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range m.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// ConnectionOpened counts an open connection.
+func (m *Metrics) ConnectionOpened() {
+	m.connectionsOpen.Inc()
+}
+
+// ConnectionClosed stops counting a connection and observes how long
+// it was open for.
+func (m *Metrics) ConnectionClosed(duration time.Duration) {
+	m.connectionsOpen.Dec()
+	m.connectionDuration.Observe(duration.Seconds())
+}
+
+// AuthenticationFailed counts a failed authentication attempt.
+func (m *Metrics) AuthenticationFailed() {
+	m.authenticationFailure.Inc()
+}
+
+// SubscriptionAdded counts an active subscription to a field.
+func (m *Metrics) SubscriptionAdded(field string) {
+	m.subscriptionsActive.WithLabelValues(field).Inc()
+}
+
+// SubscriptionRemoved stops counting a subscription to a field.
+func (m *Metrics) SubscriptionRemoved(field string) {
+	m.subscriptionsActive.WithLabelValues(field).Dec()
+}
+
+// MessageReceived counts a message received from a client.
+func (m *Metrics) MessageReceived(messageType string) {
+	m.messagesReceived.WithLabelValues(messageType).Inc()
+}
+
+// MessageQueued counts a message waiting to be sent.
+func (m *Metrics) MessageQueued(messageType string) {
+	m.sendQueueDepth.Inc()
+}
+
+// MessageSent counts a message sent to a client, which no longer
+// waits to be sent, and observes how long writing it took.
+func (m *Metrics) MessageSent(messageType string, latency time.Duration) {
+	m.sendQueueDepth.Dec()
+	m.messagesSent.WithLabelValues(messageType).Inc()
+	m.writeDuration.Observe(latency.Seconds())
+}
+
+// MessageDropped counts a dropped message by its type and the reason
+// it was dropped for.
+func (m *Metrics) MessageDropped(messageType string, reason string) {
+	// Only messages that failed to be written or were coalesced were
+	// queued before
+	if reason == graphqlws.DropReasonWriteFailed || reason == graphqlws.DropReasonCoalesced {
+		m.sendQueueDepth.Dec()
+	}
+	m.messagesDropped.WithLabelValues(messageType, reason).Inc()
+}
+
+// ExecutionCompleted observes how long executing a subscription to a
+// field took.
+func (m *Metrics) ExecutionCompleted(field string, duration time.Duration) {
+	m.executionDuration.WithLabelValues(field).Observe(duration.Seconds())
+}
@@ -0,0 +1,47 @@
+package prometheus_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	graphqlwsprometheus "github.com/functionalfoundry/graphqlws/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_QueuedMessagesAreCountedUntilSentOrDropped(t *testing.T) {
+	metrics := graphqlwsprometheus.NewMetrics("")
+
+	var _ graphqlws.Metrics = metrics
+	for i := 0; i < 4; i++ {
+		metrics.MessageQueued("data")
+	}
+	metrics.MessageSent("data", time.Millisecond)
+	metrics.MessageDropped("data", graphqlws.DropReasonWriteFailed)
+	metrics.MessageDropped("data", graphqlws.DropReasonCoalesced)
+
+	// Messages dropped before they were queued don't count
+	metrics.MessageDropped("data", graphqlws.DropReasonClosed)
+
+	expected := `
+# HELP graphqlws_messages_dropped_total Number of messages dropped by type and reason.
+# TYPE graphqlws_messages_dropped_total counter
+graphqlws_messages_dropped_total{reason="closed",type="data"} 1
+graphqlws_messages_dropped_total{reason="coalesced",type="data"} 1
+graphqlws_messages_dropped_total{reason="write_failed",type="data"} 1
+# HELP graphqlws_messages_sent_total Number of messages sent to clients by type.
+# TYPE graphqlws_messages_sent_total counter
+graphqlws_messages_sent_total{type="data"} 1
+# HELP graphqlws_send_queue_depth Number of messages waiting to be sent to clients.
+# TYPE graphqlws_send_queue_depth gauge
+graphqlws_send_queue_depth 1
+`
+	if err := testutil.CollectAndCompare(metrics, strings.NewReader(expected),
+		"graphqlws_messages_dropped_total",
+		"graphqlws_messages_sent_total",
+		"graphqlws_send_queue_depth",
+	); err != nil {
+		t.Error("Metrics are not reported correctly:", err)
+	}
+}
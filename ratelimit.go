@@ -0,0 +1,246 @@
+package graphqlws
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimitExceeded is sent to clients whose messages exceed one of
+// the configured rate limits.
+var ErrRateLimitExceeded = errors.New("Rate limit exceeded")
+
+// RateLimit defines a token bucket rate limit: clients may send up
+// to Burst messages at once and Rate messages per second on average.
+// A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (limit RateLimit) enabled() bool {
+	return limit.Rate > 0
+}
+
+// capacity returns the number of tokens a bucket holds when full; this
+// is at least one, as clients could never send a message otherwise.
+func (limit RateLimit) capacity() float64 {
+	if limit.Burst < 1 {
+		return 1
+	}
+	return float64(limit.Burst)
+}
+
+// RateLimitAction defines how connections exceeding a rate limit
+// are dealt with.
+type RateLimitAction int
+
+const (
+	// RateLimitReplyError drops messages exceeding the rate limit and
+	// replies to each of them with an error. This is the default.
+	RateLimitReplyError RateLimitAction = iota
+
+	// RateLimitClose closes connections exceeding the rate limit.
+	RateLimitClose
+)
+
+// RateLimitConfig defines the rate limits for inbound messages.
+type RateLimitConfig struct {
+	// PerConnection limits the messages of each connection.
+	PerConnection RateLimit
+
+	// PerUser limits the messages of each user, across all of the
+	// user's connections. Messages sent before the user is known
+	// (i.e. before authentication) are not limited per user.
+	PerUser RateLimit
+
+	// PerIP limits the messages of each remote IP address, across all
+	// connections from that address.
+	PerIP RateLimit
+
+	// UserKey identifies users for the per-user limit.
+	UserKey UserKeyFunc
+
+	// Action defines what happens when a limit is exceeded.
+	Action RateLimitAction
+}
+
+func (config RateLimitConfig) enabled() bool {
+	return config.PerConnection.enabled() ||
+		config.PerUser.enabled() ||
+		config.PerIP.enabled()
+}
+
+// RateLimiter decides whether a connection may send another message.
+type RateLimiter interface {
+	Allow(Connection) bool
+}
+
+/**
+ * Token buckets and the default implementation of the RateLimiter interface.
+ */
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		limit:  limit,
+		tokens: limit.capacity(),
+		last:   now,
+	}
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.last = now
+	bucket.tokens += elapsed * bucket.limit.Rate
+	if capacity := bucket.limit.capacity(); bucket.tokens > capacity {
+		bucket.tokens = capacity
+	}
+}
+
+// bucketGroup manages token buckets shared by multiple connections,
+// e.g. all connections of a user or from an IP address.
+type bucketGroup struct {
+	limit     RateLimit
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mutex     *sync.Mutex
+}
+
+// Buckets that have been refilled completely are indistinguishable from
+// new buckets; they are swept at this interval to free up memory
+const bucketSweepInterval = time.Minute
+
+func newBucketGroup(limit RateLimit) *bucketGroup {
+	return &bucketGroup{
+		limit:     limit,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// bucket returns the bucket for the given key, creating it if needed.
+// The group must be locked by the caller.
+func (group *bucketGroup) bucket(key string, now time.Time) *tokenBucket {
+	if now.Sub(group.lastSweep) > bucketSweepInterval {
+		group.lastSweep = now
+		for k, bucket := range group.buckets {
+			bucket.refill(now)
+			if bucket.tokens >= bucket.limit.capacity() {
+				delete(group.buckets, k)
+			}
+		}
+	}
+
+	bucket := group.buckets[key]
+	if bucket == nil {
+		bucket = newTokenBucket(group.limit, now)
+		group.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// rateLimits holds the buckets shared by all connections of a handler.
+type rateLimits struct {
+	config RateLimitConfig
+	users  *bucketGroup
+	ips    *bucketGroup
+}
+
+func newRateLimits(config RateLimitConfig) *rateLimits {
+	return &rateLimits{
+		config: config,
+		users:  newBucketGroup(config.PerUser),
+		ips:    newBucketGroup(config.PerIP),
+	}
+}
+
+// limiterForConnection creates a rate limiter for a new connection
+// from the given remote IP address.
+func (limits *rateLimits) limiterForConnection(ip string) RateLimiter {
+	limiter := &rateLimiter{limits: limits, ip: ip, mutex: &sync.Mutex{}}
+	if limits.config.PerConnection.enabled() {
+		limiter.bucket = newTokenBucket(limits.config.PerConnection, time.Now())
+	}
+	return limiter
+}
+
+type rateLimiter struct {
+	limits *rateLimits
+	ip     string
+	bucket *tokenBucket
+	mutex  *sync.Mutex
+}
+
+func (limiter *rateLimiter) Allow(conn Connection) bool {
+	now := time.Now()
+	config := limiter.limits.config
+
+	// Collect the buckets the message counts towards, locking them in a
+	// fixed order (connection, user, IP address)
+	buckets := []*tokenBucket{}
+	if limiter.bucket != nil {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		buckets = append(buckets, limiter.bucket)
+	}
+
+	if config.PerUser.enabled() {
+		if key, ok := keyForUser(config.UserKey, conn.User()); ok {
+			users := limiter.limits.users
+			users.mutex.Lock()
+			defer users.mutex.Unlock()
+			buckets = append(buckets, users.bucket(key, now))
+		}
+	}
+
+	if config.PerIP.enabled() && limiter.ip != "" {
+		ips := limiter.limits.ips
+		ips.mutex.Lock()
+		defer ips.mutex.Unlock()
+		buckets = append(buckets, ips.bucket(limiter.ip, now))
+	}
+
+	// Only take a token from each bucket if all of them have one, so that
+	// rejected messages don't count towards any limit
+	for _, bucket := range buckets {
+		bucket.refill(now)
+		if bucket.tokens < 1 {
+			return false
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true
+}
+
+// remoteIP returns the IP address of the client making a request. If
+// the request passed through a trusted proxy that records client
+// addresses in a header (such as X-Forwarded-For), the last address
+// in that header is used, as this is the one added by the proxy.
+func remoteIP(r *http.Request, trustedProxyHeader string) string {
+	if trustedProxyHeader != "" {
+		if header := r.Header.Get(trustedProxyHeader); header != "" {
+			addrs := strings.Split(header, ",")
+			if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+				return addr
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
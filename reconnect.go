@@ -0,0 +1,136 @@
+package graphqlws
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ClientState describes the state of the connection of a client.
+type ClientState int
+
+const (
+	// ClientConnected means that the client is connected and the
+	// connection has been acknowledged.
+	ClientConnected ClientState = iota
+
+	// ClientReconnecting means that the connection dropped and the client
+	// is trying to reconnect.
+	ClientReconnecting
+
+	// ClientClosed means that the client has been closed, either
+	// deliberately or because the connection dropped for good.
+	ClientClosed
+)
+
+func (state ClientState) String() string {
+	switch state {
+	case ClientConnected:
+		return "connected"
+	case ClientReconnecting:
+		return "reconnecting"
+	case ClientClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Backoff defines how long clients wait between reconnection attempts:
+// the wait grows exponentially from InitialInterval to MaxInterval and
+// is randomized by Jitter. Zero values are replaced with defaults.
+type Backoff struct {
+	// InitialInterval is the wait before the first attempt (default 500ms).
+	InitialInterval time.Duration
+
+	// MaxInterval caps the wait between attempts (default 30s).
+	MaxInterval time.Duration
+
+	// Multiplier is the factor the wait grows by after every failed
+	// attempt (default 2).
+	Multiplier float64
+
+	// Jitter is the fraction of the wait that is randomized, between 0
+	// and 1 (default 0.5), so that clients don't reconnect in lockstep.
+	Jitter float64
+
+	// MaxAttempts is the number of attempts before giving up and closing
+	// the client; zero means trying forever.
+	MaxAttempts int
+}
+
+// interval returns how long to wait before the given (zero-based)
+// reconnection attempt.
+func (b Backoff) interval(attempt int) time.Duration {
+	initial := b.InitialInterval
+	if initial <= 0 {
+		initial = 500 * time.Millisecond
+	}
+	max := b.MaxInterval
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	jitter := b.Jitter
+	if jitter <= 0 || jitter > 1 {
+		jitter = 0.5
+	}
+
+	interval := float64(initial) * math.Pow(multiplier, float64(attempt))
+	if interval > float64(max) {
+		interval = float64(max)
+	}
+
+	// Randomize the interval within [interval * (1 - jitter), interval]
+	interval -= interval * jitter * rand.Float64()
+	return time.Duration(interval)
+}
+
+// reconnect tries to reestablish the connection of a client until it
+// succeeds, runs out of attempts or the client is closed. Once
+// reconnected, all active operations are started again with their IDs,
+// resuming from the cursor of their last result if there is one.
+func (c *client) reconnect() (*websocket.Conn, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		if c.config.Backoff.MaxAttempts > 0 && attempt >= c.config.Backoff.MaxAttempts {
+			return nil, lastErr
+		}
+
+		select {
+		case <-time.After(c.config.Backoff.interval(attempt)):
+		case <-c.ctx.Done():
+			return nil, ErrClientClosed
+		}
+
+		ws, err := c.connect(c.ctx)
+		if err != nil {
+			c.logger.WithFields(LogFields{
+				"attempt": attempt + 1,
+				"err":     err,
+			}).Warn("Failed to reconnect")
+			lastErr = err
+			continue
+		}
+
+		c.mutex.Lock()
+		if c.closed {
+			c.mutex.Unlock()
+			ws.Close()
+			return nil, ErrClientClosed
+		}
+		c.ws = ws
+		c.connected = true
+		for id, op := range c.operations {
+			c.writeTo(ws, startMessage(id, op.resumePayload()))
+		}
+		c.mutex.Unlock()
+
+		c.changeState(ClientConnected, nil)
+		return ws, nil
+	}
+}
@@ -0,0 +1,199 @@
+package graphqlws
+
+import (
+	"sync"
+)
+
+// registeredConnection holds what the connection registry knows about
+// a connection.
+type registeredConnection struct {
+	conn    *connection
+	seq     uint64
+	ip      string
+	user    string
+	evicted bool
+}
+
+// connectionRegistry keeps track of the open connections of a handler
+// and enforces the connection limits.
+type connectionRegistry struct {
+	limits  ConnectionLimits
+	entries map[Connection]*registeredConnection
+	seq     uint64
+	total   int
+	ips     map[string]int
+	users   map[string]int
+	mutex   *sync.Mutex
+}
+
+func newConnectionRegistry(limits ConnectionLimits) *connectionRegistry {
+	return &connectionRegistry{
+		limits:  limits,
+		entries: make(map[Connection]*registeredConnection),
+		ips:     make(map[string]int),
+		users:   make(map[string]int),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// admit reserves a slot for a new connection from the given IP address.
+// If this exceeds a connection limit, it either refuses the connection
+// or returns existing connections to close in its favor, depending on
+// the connection limit policy.
+func (r *connectionRegistry) admit(ip string) ([]*connection, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	victims := []*connection{}
+	for {
+		overTotal := r.limits.MaxConnections > 0 &&
+			r.total >= r.limits.MaxConnections
+		overIP := r.limits.MaxConnectionsPerIP > 0 && ip != "" &&
+			r.ips[ip] >= r.limits.MaxConnectionsPerIP
+		if !overTotal && !overIP {
+			break
+		}
+
+		if r.limits.Policy == RejectNewConnections {
+			return nil, false
+		}
+
+		var victim *registeredConnection
+		if overIP {
+			victim = r.pick(func(e *registeredConnection) bool { return e.ip == ip })
+		} else {
+			victim = r.pick(func(e *registeredConnection) bool { return true })
+		}
+		if victim == nil {
+			return nil, false
+		}
+		r.evict(victim)
+		victims = append(victims, victim.conn)
+	}
+
+	r.total++
+	if ip != "" {
+		r.ips[ip]++
+	}
+	return victims, true
+}
+
+// release gives up a slot reserved for a connection that could not
+// be established after all.
+func (r *connectionRegistry) release(ip string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.total--
+	r.decrementIP(ip)
+}
+
+// add registers a connection in the slot reserved for it.
+func (r *connectionRegistry) add(conn *connection, ip string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.seq++
+	r.entries[conn] = &registeredConnection{conn: conn, seq: r.seq, ip: ip}
+}
+
+// authenticate associates a connection with a user. If this exceeds
+// the per-user connection limit, it either refuses the user or returns
+// other connections of the user to close, depending on the policy.
+func (r *connectionRegistry) authenticate(
+	conn Connection,
+	user string,
+) ([]*connection, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.entries[conn]
+	if entry == nil || entry.evicted || entry.user == user {
+		return nil, true
+	}
+
+	victims := []*connection{}
+	for r.limits.MaxConnectionsPerUser > 0 &&
+		r.users[user] >= r.limits.MaxConnectionsPerUser {
+		if r.limits.Policy == RejectNewConnections {
+			return nil, false
+		}
+
+		victim := r.pick(func(e *registeredConnection) bool {
+			return e.user == user && e != entry
+		})
+		if victim == nil {
+			return nil, false
+		}
+		r.evict(victim)
+		victims = append(victims, victim.conn)
+	}
+
+	r.decrementUser(entry.user)
+	entry.user = user
+	r.users[user]++
+	return victims, true
+}
+
+// remove unregisters a closed connection.
+func (r *connectionRegistry) remove(conn Connection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.entries[conn]
+	if entry == nil {
+		return
+	}
+	delete(r.entries, conn)
+	if !entry.evicted {
+		r.evict(entry)
+	}
+}
+
+// pick selects the oldest or newest connection matching a filter,
+// depending on the connection limit policy.
+func (r *connectionRegistry) pick(
+	filter func(*registeredConnection) bool,
+) *registeredConnection {
+	var picked *registeredConnection
+	for _, entry := range r.entries {
+		if entry.evicted || !filter(entry) {
+			continue
+		}
+		if picked == nil ||
+			(r.limits.Policy == CloseOldestConnections && entry.seq < picked.seq) ||
+			(r.limits.Policy == CloseNewestConnections && entry.seq > picked.seq) {
+			picked = entry
+		}
+	}
+	return picked
+}
+
+// evict stops counting a connection towards the limits; this happens
+// as soon as it is chosen to be closed, so that it isn't chosen twice.
+func (r *connectionRegistry) evict(entry *registeredConnection) {
+	entry.evicted = true
+	r.total--
+	r.decrementIP(entry.ip)
+	r.decrementUser(entry.user)
+}
+
+func (r *connectionRegistry) decrementIP(ip string) {
+	if ip == "" {
+		return
+	}
+	r.ips[ip]--
+	if r.ips[ip] <= 0 {
+		delete(r.ips, ip)
+	}
+}
+
+func (r *connectionRegistry) decrementUser(user string) {
+	if user == "" {
+		return
+	}
+	r.users[user]--
+	if r.users[user] <= 0 {
+		delete(r.users, user)
+	}
+}
@@ -0,0 +1,262 @@
+package graphqlws
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultEventRetention is the number of events per field that memory
+// event stores retain by default.
+const DefaultEventRetention = 1000
+
+// cursorKey is the name of the extension (or variable) clients resume
+// subscriptions with, and of the extension data messages carry the
+// cursor of their event in.
+const cursorKey = "cursor"
+
+var (
+	// ErrCursorExpired is returned when a subscription is resumed from a
+	// cursor that some of the events published since are no longer
+	// retained for. Clients have to start over without a cursor.
+	ErrCursorExpired = errors.New("Events since the cursor are no longer available")
+
+	// ErrInvalidCursor is returned when a subscription is resumed from a
+	// cursor that is not a sequence number.
+	ErrInvalidCursor = errors.New("Invalid cursor")
+)
+
+// StoredEvent is an event recorded by an event store, along with the
+// sequence number it was assigned.
+type StoredEvent struct {
+	Sequence uint64
+	Event    interface{}
+}
+
+// EventStore records the events published for subscription fields, so
+// that subscriptions resumed from a cursor (e.g. after the client has
+// reconnected) can be sent the events they missed.
+type EventStore interface {
+	// Append records an event published for a field and returns the
+	// sequence number assigned to it. Sequence numbers increase across
+	// all fields.
+	Append(field string, event interface{}) (uint64, error)
+
+	// Since returns the events recorded for a field after the given
+	// sequence number, oldest first, including all events whose Append
+	// has returned. It returns ErrCursorExpired if some of these events
+	// are no longer retained.
+	Since(field string, sequence uint64) ([]StoredEvent, error)
+}
+
+/**
+ * The default implementation of the EventStore interface.
+ */
+
+// MemoryEventStore is an in-memory EventStore that retains a bounded
+// number of the most recent events per field. It is safe for concurrent
+// use, but only suited for a single server process, as sequence numbers
+// start over whenever the process restarts.
+type MemoryEventStore struct {
+	retention int
+	sequence  uint64
+	events    map[string][]StoredEvent
+	evicted   map[string]uint64
+	mutex     *sync.Mutex
+}
+
+// NewMemoryEventStore creates a memory event store that retains up to
+// retention events per field (DefaultEventRetention if zero).
+func NewMemoryEventStore(retention int) *MemoryEventStore {
+	if retention <= 0 {
+		retention = DefaultEventRetention
+	}
+
+	store := new(MemoryEventStore)
+	store.retention = retention
+	store.events = make(map[string][]StoredEvent)
+	store.evicted = make(map[string]uint64)
+	store.mutex = &sync.Mutex{}
+	return store
+}
+
+// Append records an event published for a field.
+func (store *MemoryEventStore) Append(field string, event interface{}) (uint64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.sequence++
+	events := append(store.events[field], StoredEvent{
+		Sequence: store.sequence,
+		Event:    event,
+	})
+
+	// Evict the oldest events, remembering the last evicted sequence
+	// number to detect cursors that can no longer be resumed from
+	if len(events) > store.retention {
+		evicted := len(events) - store.retention
+		store.evicted[field] = events[evicted-1].Sequence
+		events = events[evicted:]
+	}
+
+	store.events[field] = events
+	return store.sequence, nil
+}
+
+// Since returns the events recorded for a field after a sequence number.
+func (store *MemoryEventStore) Since(field string, sequence uint64) ([]StoredEvent, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Cursors from the future were issued before the store started over
+	if sequence < store.evicted[field] || sequence > store.sequence {
+		return nil, ErrCursorExpired
+	}
+
+	events := store.events[field]
+	i := sort.Search(len(events), func(i int) bool {
+		return events[i].Sequence > sequence
+	})
+	return append([]StoredEvent(nil), events[i:]...), nil
+}
+
+// subscriptionReplay tracks replaying missed events to a resumed
+// subscription. Its mutex is held until the replay has finished, so that
+// events published meanwhile are delivered after the replayed ones.
+type subscriptionReplay struct {
+	cursor uint64
+
+	// replayed holds the last sequence number replayed per field; events
+	// up to it are not delivered again when they are published
+	replayed map[string]uint64
+
+	// expired is set if the subscription could not be resumed
+	expired bool
+
+	mutex *sync.Mutex
+}
+
+// skips returns true if a published event has been replayed already.
+// Events that failed to be recorded are never skipped.
+func (replay *subscriptionReplay) skips(field string, sequence uint64) bool {
+	if replay.expired {
+		return true
+	}
+	if sequence == 0 {
+		return false
+	}
+	if sequence <= replay.cursor {
+		return true
+	}
+	return sequence <= replay.replayed[field]
+}
+
+// cursorForSubscription returns the cursor to resume a subscription
+// from, which clients pass as the cursor extension or variable, either
+// as a string or as a number.
+func cursorForSubscription(s *Subscription) (uint64, bool, error) {
+	value, ok := s.Extensions[cursorKey]
+	if !ok {
+		value, ok = s.Variables[cursorKey]
+	}
+	if !ok || value == nil {
+		return 0, false, nil
+	}
+
+	switch cursor := value.(type) {
+	case string:
+		sequence, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return 0, false, ErrInvalidCursor
+		}
+		return sequence, true, nil
+	case float64:
+		if cursor < 0 || cursor != math.Trunc(cursor) {
+			return 0, false, ErrInvalidCursor
+		}
+		return uint64(cursor), true, nil
+	case int:
+		if cursor < 0 {
+			return 0, false, ErrInvalidCursor
+		}
+		return uint64(cursor), true, nil
+	case uint64:
+		return cursor, true, nil
+	}
+	return 0, false, ErrInvalidCursor
+}
+
+// cursorExtensions returns the extensions of data messages for the
+// event with the given sequence number.
+func cursorExtensions(sequence uint64) map[string]interface{} {
+	if sequence == 0 {
+		return nil
+	}
+	return map[string]interface{}{
+		cursorKey: strconv.FormatUint(sequence, 10),
+	}
+}
+
+// replayEvents sends the events a resumed subscription missed and
+// releases its replay lock. If the events can no longer be replayed,
+// the subscription is removed again.
+func (m *subscriptionManager) replayEvents(
+	ctx context.Context,
+	conn Connection,
+	subscription *Subscription,
+) []error {
+	replay := subscription.replay
+	defer replay.mutex.Unlock()
+
+	// Collect the missed events of all selected fields in the order they
+	// were published
+	type fieldEvent struct {
+		field string
+		StoredEvent
+	}
+	events := []fieldEvent{}
+	for _, field := range subscription.Fields {
+		stored, err := m.config.EventStore.Since(field, replay.cursor)
+		if err != nil {
+			m.logger.WithFields(LogFields{
+				"conn":         conn.ID(),
+				"subscription": subscription.ID,
+				"cursor":       replay.cursor,
+				"err":          err,
+			}).Warn("Failed to replay events")
+
+			replay.expired = true
+			m.mutex.Lock()
+			if m.subscriptions[conn][subscription.ID] == subscription {
+				m.removeSubscription(conn, subscription.ID)
+			}
+			m.mutex.Unlock()
+			return []error{err}
+		}
+
+		for _, event := range stored {
+			events = append(events, fieldEvent{field, event})
+			replay.replayed[field] = event.Sequence
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Sequence < events[j].Sequence
+	})
+
+	m.logger.WithFields(LogFields{
+		"conn":         conn.ID(),
+		"subscription": subscription.ID,
+		"cursor":       replay.cursor,
+		"events":       len(events),
+	}).Debug("Replay events")
+
+	for _, event := range events {
+		if subscription.Accepts(event.field, event.Event) {
+			m.execute(ctx, subscription, event.field, event.Event, event.Sequence, nil)
+		}
+	}
+	return nil
+}
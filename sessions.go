@@ -0,0 +1,409 @@
+package graphqlws
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultSessionBufferSize is the number of messages buffered for a
+// parked session by default.
+const DefaultSessionBufferSize = 100
+
+var (
+	// ErrSessionUserMismatch is the reason for rejecting connections that
+	// present the session ID of a session belonging to a different user.
+	ErrSessionUserMismatch = errors.New("Session belongs to a different user")
+
+	// ErrSessionTakenOver is the reason for closing connections whose
+	// session has been resumed by another connection.
+	ErrSessionTakenOver = errors.New("Session resumed by another connection")
+)
+
+// SessionConfig configures sessions, which let subscriptions survive
+// connection drops. Clients opt into sessions by sending a session ID
+// with connection_init (see InitMessagePayload). When the connection of
+// a session drops, its subscriptions are parked for a grace period and
+// re-attached to the next connection presenting the same session ID,
+// without parsing, validating or authorizing them again. Results are
+// buffered while the session is parked.
+//
+// Session IDs should be generated by clients with enough randomness to
+// be unguessable; sessions can only be resumed by the same user.
+type SessionConfig struct {
+	// GracePeriod is how long the subscriptions of a session are parked
+	// after its connection drops. Sessions are disabled if zero.
+	GracePeriod time.Duration
+
+	// BufferSize limits the number of messages buffered for a parked
+	// session (DefaultSessionBufferSize if zero); further messages are
+	// dropped.
+	BufferSize int
+}
+
+func (config SessionConfig) enabled() bool {
+	return config.GracePeriod > 0
+}
+
+// startedSubscriptions keeps track of the subscriptions started by the
+// client of a connection or session.
+type startedSubscriptions struct {
+	subscriptions map[string]*Subscription
+	mutex         *sync.Mutex
+}
+
+func newStartedSubscriptions() *startedSubscriptions {
+	return &startedSubscriptions{
+		subscriptions: make(map[string]*Subscription),
+		mutex:         &sync.Mutex{},
+	}
+}
+
+func (started *startedSubscriptions) get(id string) *Subscription {
+	started.mutex.Lock()
+	defer started.mutex.Unlock()
+	return started.subscriptions[id]
+}
+
+func (started *startedSubscriptions) remove(id string) *Subscription {
+	started.mutex.Lock()
+	defer started.mutex.Unlock()
+	subscription := started.subscriptions[id]
+	delete(started.subscriptions, id)
+	return subscription
+}
+
+// track adds a subscription unless another subscription with the same
+// ID has been added, and returns whether it was added.
+func (started *startedSubscriptions) track(subscription *Subscription) bool {
+	started.mutex.Lock()
+	defer started.mutex.Unlock()
+	if started.subscriptions[subscription.ID] != nil {
+		return false
+	}
+	started.subscriptions[subscription.ID] = subscription
+	return true
+}
+
+// drop removes a subscription unless it has been replaced by another
+// subscription with the same ID, and returns whether it was removed.
+func (started *startedSubscriptions) drop(subscription *Subscription) bool {
+	started.mutex.Lock()
+	defer started.mutex.Unlock()
+	if started.subscriptions[subscription.ID] != subscription {
+		return false
+	}
+	delete(started.subscriptions, subscription.ID)
+	return true
+}
+
+func (started *startedSubscriptions) all() []*Subscription {
+	started.mutex.Lock()
+	defer started.mutex.Unlock()
+	subscriptions := make([]*Subscription, 0, len(started.subscriptions))
+	for _, subscription := range started.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// restarts returns true if a start payload restarts a subscription of a
+// resumed session unchanged, i.e. with the same query, operation name
+// and variables (the cursor it resumes from may differ).
+func restarts(subscription *Subscription, data *StartMessagePayload) bool {
+	if data.OperationName != subscription.OperationName {
+		return false
+	}
+	if (len(data.Variables) > 0 || len(subscription.Variables) > 0) &&
+		!reflect.DeepEqual(data.Variables, subscription.Variables) {
+		return false
+	}
+
+	// Persisted queries are identified by their ID, as the query of the
+	// subscription has been resolved already
+	if data.Query != "" {
+		return data.Query == subscription.Query
+	}
+	id := data.ID
+	if id == "" {
+		id = persistedQueryIDFromExtensions(data.Extensions)
+	}
+	return id != "" && id == subscription.PersistedQueryID
+}
+
+/**
+ * Sessions and the registry managing them.
+ */
+
+// session is the Connection that the subscriptions of a session are
+// registered with. It forwards messages to the connection the session
+// is attached to, or buffers them while the session is parked.
+type session struct {
+	id       string
+	user     interface{}
+	started  *startedSubscriptions
+	registry *sessionRegistry
+
+	// owner is the connection that claimed the session last; conn is the
+	// connection messages are forwarded to once the owner is acknowledged
+	owner *connection
+	conn  *connection
+
+	// pending holds the messages buffered while no connection is attached
+	pending []OperationMessage
+
+	// ctx is the context of the session, which (unlike the contexts of
+	// its connections) lives until the session expires
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// timer removes the session when its grace period expires; expired is
+	// set once it has
+	timer   *time.Timer
+	expired bool
+
+	// mutex guards the state of the session and is never held while
+	// sending; forwardMutex keeps messages forwarded to a connection in
+	// order
+	mutex        *sync.Mutex
+	forwardMutex *sync.Mutex
+}
+
+// ID returns the ID of the connection the session was last claimed by.
+func (s *session) ID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.owner != nil {
+		return s.owner.ID()
+	}
+	return s.id
+}
+
+func (s *session) User() interface{} {
+	return s.user
+}
+
+func (s *session) Context() context.Context {
+	return s.ctx
+}
+
+func (s *session) SendData(opID string, data *DataMessagePayload) {
+	msg := operationMessageForType(gqlData)
+	msg.ID = opID
+	msg.Payload = data
+	s.send(msg)
+}
+
+func (s *session) SendError(err error) {
+	msg := operationMessageForType(gqlError)
+	msg.Payload = err.Error()
+	s.send(msg)
+}
+
+func (s *session) SendComplete(opID string) {
+	msg := operationMessageForType(gqlComplete)
+	msg.ID = opID
+	s.send(msg)
+}
+
+func (s *session) send(msg OperationMessage) {
+	s.forwardMutex.Lock()
+	defer s.forwardMutex.Unlock()
+
+	s.mutex.Lock()
+	conn := s.conn
+	if conn == nil {
+		if len(s.pending) >= s.registry.bufferSize {
+			s.registry.metrics.MessageDropped(msg.Type, DropReasonBufferFull)
+		} else {
+			s.pending = append(s.pending, msg)
+		}
+	}
+	s.mutex.Unlock()
+
+	if conn != nil {
+		conn.send(msg)
+	}
+}
+
+// attach forwards the messages of the session to its owner from now on,
+// starting with the messages buffered while it was parked.
+func (s *session) attach(conn *connection) {
+	s.forwardMutex.Lock()
+	defer s.forwardMutex.Unlock()
+
+	s.mutex.Lock()
+	if s.owner != conn {
+		s.mutex.Unlock()
+		return
+	}
+	pending := s.pending
+	s.pending = nil
+	s.conn = conn
+	s.mutex.Unlock()
+
+	for _, msg := range pending {
+		conn.send(msg)
+	}
+}
+
+// takeOver hands the session to a connection. It returns false if the
+// session expired in the meantime and can no longer be resumed.
+func (s *session) takeOver(conn *connection) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.expired {
+		return false, nil
+	}
+	if !reflect.DeepEqual(s.user, conn.User()) {
+		return true, ErrSessionUserMismatch
+	}
+
+	// Keep the session from expiring
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+
+	// Take the session over from its previous connection, buffering
+	// messages until the new connection is acknowledged
+	if s.owner != nil {
+		go s.owner.terminate(websocket.CloseNormalClosure, ErrSessionTakenOver.Error())
+	}
+	s.owner = conn
+	s.conn = nil
+	return true, nil
+}
+
+// sessionRegistry keeps track of the sessions of a handler.
+type sessionRegistry struct {
+	config     SessionConfig
+	bufferSize int
+	sessions   map[string]*session
+	logger     Logger
+	metrics    Metrics
+	mutex      *sync.Mutex
+}
+
+func newSessionRegistry(config SessionConfig, logger Logger, metrics Metrics) *sessionRegistry {
+	registry := new(sessionRegistry)
+	registry.config = config
+	registry.bufferSize = config.BufferSize
+	if registry.bufferSize <= 0 {
+		registry.bufferSize = DefaultSessionBufferSize
+	}
+	registry.sessions = make(map[string]*session)
+	registry.logger = logger
+	registry.metrics = metrics
+	registry.mutex = &sync.Mutex{}
+	return registry
+}
+
+// claim hands the session with the given ID to a connection, creating
+// the session if it doesn't exist. The connection that owned the session
+// before is closed (if the client reconnected before the server noticed
+// the old connection dropping).
+func (registry *sessionRegistry) claim(id string, conn *connection) (*session, error) {
+	for {
+		registry.mutex.Lock()
+		s := registry.sessions[id]
+		if s == nil {
+			// Sessions keep the values of the context of the connection
+			// that started them, but outlive it
+			ctx, cancel := context.WithCancel(context.WithoutCancel(conn.Context()))
+			s = &session{
+				id:           id,
+				user:         conn.User(),
+				started:      newStartedSubscriptions(),
+				registry:     registry,
+				owner:        conn,
+				ctx:          ctx,
+				cancel:       cancel,
+				mutex:        &sync.Mutex{},
+				forwardMutex: &sync.Mutex{},
+			}
+			registry.sessions[id] = s
+			registry.mutex.Unlock()
+			return s, nil
+		}
+		registry.mutex.Unlock()
+
+		// Sessions are locked without holding the registry lock; if the
+		// session expired in the meantime, start over with a new one
+		ok, err := s.takeOver(conn)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			registry.forget(s)
+			continue
+		}
+
+		registry.logger.WithFields(LogFields{
+			"conn":    conn.ID(),
+			"session": id,
+		}).Info("Resume session")
+		return s, nil
+	}
+}
+
+// forget removes a session from the registry, unless it has been
+// replaced by another session with the same ID.
+func (registry *sessionRegistry) forget(s *session) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	if registry.sessions[s.id] == s {
+		delete(registry.sessions, s.id)
+	}
+}
+
+// park detaches a session from the connection that dropped and removes
+// the session, calling expire and cancelling its context, unless it is
+// resumed within the grace period. Sessions that have been taken over by other connections in
+// the meantime are left alone.
+func (registry *sessionRegistry) park(s *session, conn *connection, expire func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.owner != conn {
+		return
+	}
+	s.owner = nil
+	s.conn = nil
+
+	registry.logger.WithFields(LogFields{
+		"conn":    conn.ID(),
+		"session": s.id,
+	}).Info("Park session")
+
+	s.timer = time.AfterFunc(registry.config.GracePeriod, func() {
+		s.mutex.Lock()
+		expired := s.owner == nil && !s.expired
+		if expired {
+			s.expired = true
+			s.pending = nil
+		}
+		s.mutex.Unlock()
+
+		if expired {
+			registry.forget(s)
+			registry.logger.WithField("session", s.id).Info("Session expired")
+			expire()
+			s.cancel()
+		}
+	})
+}
+
+// sessionIDForConnection returns the session ID the client of a
+// connection presented when initializing it.
+func sessionIDForConnection(conn Connection) string {
+	if c, ok := conn.(*connection); ok {
+		return c.sessionID
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// NewSSEHandler creates a handler that serves subscriptions over
+// Server-Sent Events, in the "distinct connections" mode of the
+// graphql-sse protocol: each GET or POST request starts a subscription
+// and receives its results as "next" events on a text/event-stream
+// response, followed by a "complete" event when the subscription
+// completes. The subscription is stopped when the client goes away.
+//
+// Subscriptions are added to the same SubscriptionManager as the ones of
+// WebSocket connections, so events published through the manager reach
+// subscribers of both transports.
+func NewSSEHandler(config StreamHandlerConfig) http.Handler {
+	logger := loggerForComponent(config.Logger, "sse")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveStream(config, sseFormat{}, logger, w, r)
+	})
+}
+
+// sseFormat writes subscription results as Server-Sent Events.
+type sseFormat struct{}
+
+func (sseFormat) start(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	// Keep proxies like nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (sseFormat) next(w http.ResponseWriter, result executionResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+	return err
+}
+
+func (sseFormat) complete(w http.ResponseWriter) error {
+	_, err := fmt.Fprint(w, "event: complete\ndata: \n\n")
+	return err
+}
+
+func (sseFormat) keepAlive(w http.ResponseWriter) error {
+	_, err := fmt.Fprint(w, ":\n\n")
+	return err
+}
@@ -0,0 +1,378 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// DefaultStreamKeepAlive is the default interval of keep-alive messages
+// on streaming HTTP responses.
+const DefaultStreamKeepAlive = 15 * time.Second
+
+// StreamHandlerConfig stores the configuration of handlers that serve
+// subscriptions over streaming HTTP responses (see NewSSEHandler and
+// NewMultipartHandler).
+type StreamHandlerConfig struct {
+	SubscriptionManager SubscriptionManager
+	Authenticate        AuthenticateFunc
+
+	// AuthToken extracts the token passed to Authenticate from requests.
+	// By default, the bearer token of the Authorization header is used.
+	AuthToken func(*http.Request) string
+
+	// KeepAlive is the interval of keep-alive messages, which keep
+	// proxies from closing idle responses (DefaultStreamKeepAlive if
+	// zero).
+	KeepAlive time.Duration
+
+	// Logger is used to log what the handler is doing. If nil, nothing
+	// is logged.
+	Logger Logger
+
+	// Metrics, if set, are reported what the handler is doing. Each
+	// response counts as a connection.
+	Metrics Metrics
+}
+
+// streamFormat writes the results of a subscription to a streaming
+// HTTP response in a specific format.
+type streamFormat interface {
+	// start writes the response headers.
+	start(w http.ResponseWriter)
+
+	// next writes a result of the subscription.
+	next(w http.ResponseWriter, result executionResult) error
+
+	// complete writes the end of the response.
+	complete(w http.ResponseWriter) error
+
+	// keepAlive writes a message that keeps the response from idling.
+	keepAlive(w http.ResponseWriter) error
+}
+
+// executionResult is the JSON representation of a subscription result
+// in responses, as in GraphQL over HTTP.
+type executionResult struct {
+	Data       interface{}                `json:"data"`
+	Errors     []gqlerrors.FormattedError `json:"errors,omitempty"`
+	Extensions map[string]interface{}     `json:"extensions,omitempty"`
+}
+
+func resultForPayload(payload *DataMessagePayload) executionResult {
+	result := executionResult{
+		Data:       payload.Data,
+		Extensions: payload.Extensions,
+	}
+	if len(payload.Errors) > 0 {
+		result.Errors = gqlerrors.FormatErrors(payload.Errors...)
+	}
+	return result
+}
+
+// writeErrors responds to a request with errors in a JSON result.
+func writeErrors(w http.ResponseWriter, status int, errs ...error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(executionResult{
+		Errors: gqlerrors.FormatErrors(errs...),
+	})
+}
+
+// authTokenFromRequest returns the bearer token of a request's
+// Authorization header.
+func authTokenFromRequest(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return header[7:]
+	}
+	return ""
+}
+
+// errRequestTooLarge is the error for request bodies exceeding the
+// size limit of incoming messages.
+var errRequestTooLarge = errors.New("Request body too large")
+
+// startPayloadFromRequest reads the operation to start from the JSON
+// body of a POST request or the query parameters of a GET request, as
+// in GraphQL over HTTP. Bodies are limited to the size of messages
+// accepted over WebSocket connections.
+func startPayloadFromRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+) (*StartMessagePayload, error) {
+	payload := &StartMessagePayload{}
+
+	if r.Method == http.MethodPost {
+		body := http.MaxBytesReader(w, r.Body, readLimit)
+		if err := json.NewDecoder(body).Decode(payload); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, errRequestTooLarge
+			}
+			return nil, errors.New("Invalid request body")
+		}
+		return payload, nil
+	}
+
+	params := r.URL.Query()
+	payload.Query = params.Get("query")
+	payload.OperationName = params.Get("operationName")
+	if variables := params.Get("variables"); variables != "" {
+		if err := json.Unmarshal([]byte(variables), &payload.Variables); err != nil {
+			return nil, errors.New("Invalid variables")
+		}
+	}
+	if extensions := params.Get("extensions"); extensions != "" {
+		if err := json.Unmarshal([]byte(extensions), &payload.Extensions); err != nil {
+			return nil, errors.New("Invalid extensions")
+		}
+	}
+	return payload, nil
+}
+
+// statusForRequestError returns the HTTP status for requests that
+// startPayloadFromRequest failed to read.
+func statusForRequestError(err error) int {
+	if err == errRequestTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+/**
+ * The Connection implementation of streaming HTTP responses.
+ */
+
+// streamConnection is the Connection of a subscription served over a
+// streaming HTTP response. Messages are handed to the handler writing the
+// response; messages sent before the response is started are held back.
+type streamConnection struct {
+	id       string
+	user     interface{}
+	ctx      context.Context
+	messages chan OperationMessage
+	pending  []OperationMessage
+	started  bool
+	mutex    *sync.Mutex
+}
+
+func newStreamConnection(ctx context.Context, user interface{}) *streamConnection {
+	return &streamConnection{
+		id:       uuid.New().String(),
+		user:     user,
+		ctx:      ctx,
+		messages: make(chan OperationMessage),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (conn *streamConnection) ID() string {
+	return conn.id
+}
+
+func (conn *streamConnection) User() interface{} {
+	return conn.user
+}
+
+func (conn *streamConnection) Context() context.Context {
+	return conn.ctx
+}
+
+func (conn *streamConnection) SendData(opID string, data *DataMessagePayload) {
+	msg := operationMessageForType(gqlData)
+	msg.ID = opID
+	msg.Payload = data
+	conn.send(msg)
+}
+
+func (conn *streamConnection) SendError(err error) {
+	msg := operationMessageForType(gqlError)
+	msg.Payload = []error{err}
+	conn.send(msg)
+}
+
+func (conn *streamConnection) SendComplete(opID string) {
+	msg := operationMessageForType(gqlComplete)
+	msg.ID = opID
+	conn.send(msg)
+}
+
+func (conn *streamConnection) send(msg OperationMessage) {
+	conn.mutex.Lock()
+	if !conn.started {
+		conn.pending = append(conn.pending, msg)
+		conn.mutex.Unlock()
+		return
+	}
+	conn.mutex.Unlock()
+
+	// Drop messages once the client has gone away
+	select {
+	case conn.messages <- msg:
+	case <-conn.ctx.Done():
+	}
+}
+
+// begin returns the messages held back so far; later messages are
+// handed to the handler through the messages channel.
+func (conn *streamConnection) begin() []OperationMessage {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.started = true
+	pending := conn.pending
+	conn.pending = nil
+	return pending
+}
+
+// serveStream serves a subscription over a streaming HTTP response in
+// the given format, until the subscription completes or the client goes
+// away.
+func serveStream(
+	config StreamHandlerConfig,
+	format streamFormat,
+	logger Logger,
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrors(w, http.StatusInternalServerError, errors.New("Streaming is not supported"))
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeErrors(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+
+	payload, err := startPayloadFromRequest(w, r)
+	if err != nil {
+		writeErrors(w, statusForRequestError(err), err)
+		return
+	}
+
+	// Authenticate the user
+	var user interface{}
+	if config.Authenticate != nil {
+		authToken := config.AuthToken
+		if authToken == nil {
+			authToken = authTokenFromRequest
+		}
+		user, err = config.Authenticate(authToken(r))
+		if err != nil {
+			logger.WithField("err", err).Warn("Failed to authenticate user")
+			metricsOrDefault(config.Metrics).AuthenticationFailed()
+			writeErrors(w, http.StatusUnauthorized,
+				fmt.Errorf("Failed to authenticate user: %v", err))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	conn := newStreamConnection(ctx, user)
+
+	subscription := &Subscription{
+		ID:               conn.id,
+		Query:            payload.Query,
+		Variables:        payload.Variables,
+		OperationName:    payload.OperationName,
+		Extensions:       payload.Extensions,
+		PersistedQueryID: payload.ID,
+		Connection:       conn,
+		SendData: func(data *DataMessagePayload) {
+			conn.SendData(conn.id, data)
+		},
+	}
+	if errs := config.SubscriptionManager.AddSubscription(conn, subscription); len(errs) > 0 {
+		writeErrors(w, http.StatusBadRequest, errs...)
+		return
+	}
+	defer config.SubscriptionManager.RemoveSubscription(conn, subscription)
+
+	metrics := metricsOrDefault(config.Metrics)
+	metrics.ConnectionOpened()
+	defer func(started time.Time) {
+		metrics.ConnectionClosed(time.Since(started))
+	}(time.Now())
+
+	logger.WithFields(LogFields{
+		"conn": conn.id,
+		"user": user,
+	}).Debug("Start streaming")
+
+	format.start(w)
+	flusher.Flush()
+
+	keepAlive := config.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = DefaultStreamKeepAlive
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	// write writes a message to the response and returns whether the
+	// response continues
+	write := func(msg OperationMessage) bool {
+		// Messages are written as soon as they are taken from the
+		// connection, so they are only queued for as long as that takes
+		metrics.MessageQueued(msg.Type)
+
+		start := time.Now()
+		var err error
+		switch msg.Type {
+		case gqlData:
+			err = format.next(w, resultForPayload(msg.Payload.(*DataMessagePayload)))
+		case gqlError:
+			if err = format.next(w, resultForPayload(&DataMessagePayload{
+				Errors: msg.Payload.([]error),
+			})); err == nil {
+				err = format.complete(w)
+			}
+		case gqlComplete:
+			err = format.complete(w)
+		}
+		flusher.Flush()
+
+		if err != nil {
+			logger.WithField("err", err).Warn("Failed to write to stream")
+			metrics.MessageDropped(msg.Type, DropReasonWriteFailed)
+			return false
+		}
+		metrics.MessageSent(msg.Type, time.Since(start))
+		return msg.Type == gqlData
+	}
+
+	for _, msg := range conn.begin() {
+		if !write(msg) {
+			return
+		}
+	}
+	for {
+		select {
+		case msg := <-conn.messages:
+			if !write(msg) {
+				return
+			}
+		case <-ticker.C:
+			if err := format.keepAlive(w); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			logger.WithField("conn", conn.id).Debug("Client went away")
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package graphqlws_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+)
+
+func TestStream_SubscriptionsAreServedOverSSE(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	server := httptest.NewServer(graphqlws.NewSSEHandler(graphqlws.StreamHandlerConfig{
+		SubscriptionManager: sm,
+		Authenticate: func(token string) (interface{}, error) {
+			if token == "" {
+				return nil, errors.New("No token")
+			}
+			return token, nil
+		},
+	}))
+	defer server.Close()
+
+	subscribe := func(ctx context.Context, query string, token string) *http.Response {
+		body := strings.NewReader(`{"query": "` + query + `"}`)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, body)
+		req.Header.Set("Accept", "text/event-stream")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("Failed to subscribe:", err)
+		}
+		return resp
+	}
+
+	// Verify that unauthenticated and invalid subscriptions are rejected
+	resp := subscribe(context.Background(), "subscription { users }", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Unauthenticated subscriptions are accepted:", resp.Status)
+	}
+	resp = subscribe(context.Background(), "subscription { unknown }", "joe")
+	result := map[string]interface{}{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || result["errors"] == nil {
+		t.Error("Invalid subscriptions are accepted:", resp.Status, result)
+	}
+	resp = subscribe(context.Background(), "subscription { users "+strings.Repeat(" ", 8192)+"}", "joe")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Request bodies are not limited:", resp.Status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp = subscribe(ctx, "subscription { users }", "joe")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatal("Subscription is not streamed:", resp.Status)
+	}
+	waitForTestSubscriptions(t, sm, 1)
+
+	// Verify that published events are streamed as next events
+	go sm.Publish(context.Background(), "users", map[string]interface{}{
+		"users": []string{"jane"},
+	})
+	reader := bufio.NewReader(resp.Body)
+	event, _ := reader.ReadString('\n')
+	data, _ := reader.ReadString('\n')
+	if event != "event: next\n" || data != `data: {"data":{"users":["jane"]}}`+"\n" {
+		t.Errorf("Published event is not streamed: %q %q", event, data)
+	}
+
+	// Verify that the subscription is stopped when the client goes away
+	cancel()
+	waitForTestSubscriptions(t, sm, 0)
+}
+
+func TestStream_SubscriptionsAreServedAsMultipartResponses(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema:        &schema,
+		ExecutionMode: graphqlws.ResolverExecution,
+	})
+	server := httptest.NewServer(graphqlws.NewMultipartHandler(graphqlws.StreamHandlerConfig{
+		SubscriptionManager: sm,
+	}))
+	defer server.Close()
+
+	// Verify that only POST requests are accepted
+	resp, err := http.Get(server.URL + "?query=subscription%20%7B%20users%20%7D")
+	if err != nil {
+		t.Fatal("Failed to send request:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("GET requests are accepted:", resp.Status)
+	}
+
+	// Subscriptions without a subscribe resolver complete right away
+	resp, err = http.Post(server.URL, "application/json",
+		strings.NewReader(`{"query": "subscription { users }"}`))
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), `multipart/mixed; boundary="graphql"`) {
+		t.Fatal("Subscription is not streamed as a multipart response:", resp.Header)
+	}
+
+	body := new(strings.Builder)
+	bufio.NewReader(resp.Body).WriteTo(body)
+	expected := "\r\n--graphql" +
+		"\r\nContent-Type: application/json; charset=utf-8\r\n\r\n" +
+		`{"payload":{"data":null,"errors":[{"message":"the subscription function \"users\" is not defined","locations":[]}]}}` +
+		"\r\n--graphql--\r\n"
+	if body.String() != expected {
+		t.Errorf("Unexpected multipart response: %q", body.String())
+	}
+}
+
+func TestStream_PublishedEventsAreServedAsMultipartParts(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	server := httptest.NewServer(graphqlws.NewMultipartHandler(graphqlws.StreamHandlerConfig{
+		SubscriptionManager: sm,
+		KeepAlive:           50 * time.Millisecond,
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := strings.NewReader(`{"query": "subscription { users }"}`)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, body)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	defer resp.Body.Close()
+	waitForTestSubscriptions(t, sm, 1)
+
+	// nextPart returns the JSON body of the next part of the response
+	reader := bufio.NewReader(resp.Body)
+	nextPart := func() string {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal("Failed to read part:", err)
+			}
+			if strings.HasPrefix(line, "{") {
+				return strings.TrimSpace(line)
+			}
+		}
+	}
+
+	// Verify that published events are streamed as payload parts
+	go sm.Publish(context.Background(), "users", map[string]interface{}{
+		"users": []string{"jane"},
+	})
+	if part := nextPart(); part != `{"payload":{"data":{"users":["jane"]}}}` {
+		t.Errorf("Published event is not streamed: %q", part)
+	}
+
+	// Verify that empty parts are sent as heartbeats
+	if part := nextPart(); part != "{}" {
+		t.Errorf("Heartbeats are not sent: %q", part)
+	}
+
+	// Verify that the subscription is stopped when the client goes away
+	cancel()
+	waitForTestSubscriptions(t, sm, 0)
+}
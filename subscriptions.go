@@ -1,13 +1,16 @@
 package graphqlws
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/graphql/gqlerrors"
 	"github.com/graphql-go/graphql/language/ast"
 	"github.com/graphql-go/graphql/language/parser"
-	log "github.com/sirupsen/logrus"
 )
 
 // ErrorsFromGraphQLErrors convert from GraphQL errors to regular errors.
@@ -27,18 +30,63 @@ func ErrorsFromGraphQLErrors(errors []gqlerrors.FormattedError) []error {
 // for a specific subscription to the corresponding subscriber.
 type SubscriptionSendDataFunc func(*DataMessagePayload)
 
+// SubscriptionFilterFunc is a function that decides whether an event
+// published for a subscription field is delivered to a subscriber. It
+// is passed the event, the arguments the field is selected with and
+// the user associated with the subscriber's connection.
+type SubscriptionFilterFunc func(
+	event interface{},
+	args map[string]interface{},
+	user interface{},
+) bool
+
+// SubscriptionField describes a top-level field selected by a
+// subscription query, along with the alias it is selected as (or its
+// name if there is no alias) and the arguments it is selected with.
+// Variables used as argument values are substituted. The filter, if
+// any, is the one declared for the field by the schema author.
+type SubscriptionField struct {
+	Name      string
+	Alias     string
+	Arguments map[string]interface{}
+	Filter    SubscriptionFilterFunc
+}
+
 // Subscription holds all information about a GraphQL subscription
 // made by a client, including a function to send data back to the
 // client when there are updates to the subscription query result.
 type Subscription struct {
-	ID            string
-	Query         string
-	Variables     map[string]interface{}
-	OperationName string
-	Document      *ast.Document
-	Fields        []string
-	Connection    Connection
-	SendData      SubscriptionSendDataFunc
+	ID               string
+	Query            string
+	Variables        map[string]interface{}
+	OperationName    string
+	Extensions       map[string]interface{}
+	PersistedQueryID string
+	Document         *ast.Document
+	Fields           []string
+	Selections       []SubscriptionField
+	Connection       Connection
+	SendData         SubscriptionSendDataFunc
+
+	// Complete, if set, is called once the server has completed the
+	// subscription (when the source event stream of its subscribe
+	// resolver is closed) and removed it
+	Complete func()
+
+	// cancel stops the source event stream of a subscription executed
+	// through its field's subscribe resolver
+	cancel context.CancelFunc
+
+	// span is the span that traced starting the subscription; spans for
+	// executing it are linked to it
+	span Span
+
+	// userKey identifies the user the subscription counts towards
+	userKey string
+
+	// replay tracks replaying missed events if the subscription is
+	// resumed from a cursor
+	replay *subscriptionReplay
 }
 
 // MatchesField returns true if the subscription is for data that
@@ -58,6 +106,54 @@ func (s *Subscription) MatchesField(field string) bool {
 	return false
 }
 
+// Accepts returns true if an event published for the given field
+// passes the filter of at least one selection of the field. Selections
+// without a filter accept all events.
+func (s *Subscription) Accepts(field string, event interface{}) bool {
+	var user interface{}
+	if s.Connection != nil {
+		user = s.Connection.User()
+	}
+
+	for _, selection := range s.Selections {
+		if selection.Name != field {
+			continue
+		}
+		if selection.Filter == nil ||
+			selection.Filter(event, selection.Arguments, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesArguments returns true if the subscription selects the given
+// field with the given (canonically encoded) argument values.
+func (s *Subscription) matchesArguments(field string, keys map[string]string) bool {
+	for _, selection := range s.Selections {
+		if selection.Name != field {
+			continue
+		}
+
+		matches := true
+		for name, key := range keys {
+			value, ok := selection.Arguments[name]
+			if !ok {
+				matches = false
+				break
+			}
+			if valueKey, ok := argumentKey(value); !ok || valueKey != key {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
 // ConnectionSubscriptions defines a map of all subscriptions of
 // a connection by their IDs.
 type ConnectionSubscriptions map[string]*Subscription
@@ -69,8 +165,8 @@ type Subscriptions map[Connection]ConnectionSubscriptions
 // SubscriptionManager provides a high-level interface to managing
 // and accessing the subscriptions made by GraphQL WS clients.
 type SubscriptionManager interface {
-	// Subscriptions returns all registered subscriptions, grouped
-	// by connection.
+	// Subscriptions returns a snapshot of all registered subscriptions,
+	// grouped by connection.
 	Subscriptions() Subscriptions
 
 	// AddSubscription adds a new subscription to the manager.
@@ -81,6 +177,97 @@ type SubscriptionManager interface {
 
 	// RemoveSubscriptions removes all subscriptions of a client connection.
 	RemoveSubscriptions(Connection)
+
+	// SubscriptionsForField returns all subscriptions that select the
+	// given top-level field. If arguments are passed, only subscriptions
+	// that select the field with the same argument values are returned.
+	SubscriptionsForField(string, map[string]interface{}) []*Subscription
+
+	// Publish executes all subscriptions selecting the given field with
+	// the event as the root value and sends the results to subscribers.
+	// Subscriptions whose filters reject the event are skipped.
+	Publish(context.Context, string, interface{})
+}
+
+// SubscriptionExecutionMode defines how the subscription manager
+// executes subscriptions.
+type SubscriptionExecutionMode int
+
+const (
+	// PublishExecution executes subscriptions whenever events are
+	// published through the subscription manager (or whenever the
+	// application executes them itself). This is the default.
+	PublishExecution SubscriptionExecutionMode = iota
+
+	// ResolverExecution executes subscriptions through the Subscribe
+	// functions of their fields as soon as they are added. Each event
+	// sent on the returned channel is executed and sent to the client;
+	// the subscription completes when the channel is closed.
+	ResolverExecution
+)
+
+// SubscriptionManagerConfig defines the configuration parameters of
+// a subscription manager.
+type SubscriptionManagerConfig struct {
+	// Schema is the GraphQL schema subscriptions are validated and
+	// executed against.
+	Schema *graphql.Schema
+
+	// Filters maps subscription field names to filters that decide
+	// which subscribers of a field an event is delivered to.
+	Filters map[string]SubscriptionFilterFunc
+
+	// ExecutionMode defines how subscriptions are executed.
+	ExecutionMode SubscriptionExecutionMode
+
+	// RootValue is passed to the subscribe resolvers when executing
+	// subscriptions in ResolverExecution mode.
+	RootValue interface{}
+
+	// Context returns the context that the subscriptions of a connection
+	// are executed in when using ResolverExecution mode. Subscriptions
+	// are executed in the background context if this is nil.
+	Context func(Connection) context.Context
+
+	// PersistedQueries resolves the persisted query IDs that clients
+	// send instead of query strings, either as the ID of the start
+	// payload or in Apollo's persistedQuery extension format.
+	PersistedQueries PersistedQueryStore
+
+	// AllowPersistedQueriesOnly rejects all subscriptions whose query is
+	// not in the persisted query store. Plain query strings are looked up
+	// by their PersistedQueryID.
+	AllowPersistedQueriesOnly bool
+
+	// DocumentCache caches parsed and validated subscription queries.
+	// Queries are parsed and validated for every subscription if nil.
+	DocumentCache *DocumentCache
+
+	// ComplexityLimits limits the depth and cost of subscription queries.
+	ComplexityLimits ComplexityLimits
+
+	// UserComplexityLimits returns the complexity limits for the user of
+	// a connection. If set, it takes precedence over ComplexityLimits.
+	UserComplexityLimits ComplexityLimitsFunc
+
+	// Limits limits the number of active subscriptions.
+	Limits SubscriptionLimits
+
+	// Logger is used to log what the subscription manager is doing.
+	// If nil, nothing is logged.
+	Logger Logger
+
+	// Metrics, if set, are reported what the subscription manager is doing.
+	Metrics Metrics
+
+	// Tracer traces starting and executing subscriptions. If nil, nothing
+	// is traced.
+	Tracer Tracer
+
+	// EventStore, if set, records published events so that subscriptions
+	// resumed from a cursor are sent the events they missed before any
+	// new ones. Only used with PublishExecution.
+	EventStore EventStore
 }
 
 /**
@@ -89,60 +276,203 @@ type SubscriptionManager interface {
 
 type subscriptionManager struct {
 	subscriptions Subscriptions
+	count         int
+	userCounts    map[string]int
+	index         *subscriptionIndex
 	schema        *graphql.Schema
-	logger        *log.Entry
+	resolving     graphql.Schema
+	config        SubscriptionManagerConfig
+	logger        Logger
+	metrics       Metrics
+	tracer        Tracer
+	mutex         *sync.Mutex
 }
 
 // NewSubscriptionManager creates a new subscription manager.
 func NewSubscriptionManager(schema *graphql.Schema) SubscriptionManager {
+	return NewSubscriptionManagerWithConfig(SubscriptionManagerConfig{
+		Schema: schema,
+	})
+}
+
+// NewSubscriptionManagerWithConfig creates a new subscription manager
+// with the given configuration.
+func NewSubscriptionManagerWithConfig(
+	config SubscriptionManagerConfig,
+) SubscriptionManager {
 	manager := new(subscriptionManager)
 	manager.subscriptions = make(Subscriptions)
-	manager.logger = NewLogger("subscriptions")
-	manager.schema = schema
+	manager.userCounts = make(map[string]int)
+	manager.index = newSubscriptionIndex()
+	manager.logger = loggerForComponent(config.Logger, "subscriptions")
+	manager.metrics = metricsOrDefault(config.Metrics)
+	manager.tracer = tracerOrDefault(config.Tracer)
+	manager.schema = config.Schema
+	manager.config = config
+	if config.ExecutionMode == ResolverExecution && config.Schema != nil {
+		// Subscriptions are executed for the events of their source
+		// streams by graphql-go, so time them with an extension
+		manager.resolving = *config.Schema
+		manager.resolving.AddExtensions(&executionTimer{metrics: manager.metrics})
+	}
+	manager.mutex = &sync.Mutex{}
 	return manager
 }
 
 func (m *subscriptionManager) Subscriptions() Subscriptions {
-	return m.subscriptions
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Return a copy, as subscriptions may be added and removed while
+	// callers iterate over them
+	subscriptions := make(Subscriptions, len(m.subscriptions))
+	for conn, connSubscriptions := range m.subscriptions {
+		subscriptions[conn] = make(ConnectionSubscriptions, len(connSubscriptions))
+		for id, subscription := range connSubscriptions {
+			subscriptions[conn][id] = subscription
+		}
+	}
+	return subscriptions
 }
 
 func (m *subscriptionManager) AddSubscription(
 	conn Connection,
 	subscription *Subscription,
 ) []error {
-	m.logger.WithFields(log.Fields{
+	ctx, span := m.tracer.Start(contextForConnection(conn), "graphqlws.start", SpanOptions{
+		Attributes: subscriptionAttributes(conn, subscription),
+	})
+	subscription.span = span
+
+	errs := m.addSubscription(span, conn, subscription)
+	if len(errs) == 0 && subscription.replay != nil {
+		errs = m.replayEvents(ctx, conn, subscription)
+	}
+
+	// Subscribe to the source event stream of the subscription if it
+	// is to be executed through the subscribe resolver of its field;
+	// this happens outside of the lock, as it calls into the application
+	if len(errs) == 0 && m.config.ExecutionMode == ResolverExecution {
+		m.executeSubscription(conn, subscription)
+	}
+	span.End(errs...)
+	return errs
+}
+
+func (m *subscriptionManager) addSubscription(
+	span Span,
+	conn Connection,
+	subscription *Subscription,
+) []error {
+	m.logger.WithFields(LogFields{
 		"conn":         conn.ID(),
 		"subscription": subscription.ID,
 	}).Info("Add subscription")
 
+	// Resolve persisted queries and enforce the query allowlist
+	if errors := resolvePersistedQuery(
+		subscription,
+		m.config.PersistedQueries,
+		m.config.AllowPersistedQueriesOnly,
+	); len(errors) > 0 {
+		m.logger.WithField("errors", errors).Warn("Failed to resolve persisted query")
+		return errors
+	}
+
 	if errors := validateSubscription(subscription); len(errors) > 0 {
 		m.logger.WithField("errors", errors).Warn("Failed to add invalid subscription")
 		return errors
 	}
 
-	// Parse the subscription query
-	document, err := parser.Parse(parser.ParseParams{
-		Source: subscription.Query,
-	})
+	// Parse and validate the subscription query
+	document, validation, err := m.parseAndValidate(subscription.Query)
 	if err != nil {
 		m.logger.WithField("err", err).Warn("Failed to parse subscription query")
 		return []error{err}
 	}
-
-	// Validate the query document
-	validation := graphql.ValidateDocument(m.schema, document, nil)
 	if !validation.IsValid {
-		m.logger.WithFields(log.Fields{
+		m.logger.WithFields(LogFields{
 			"errors": validation.Errors,
 		}).Warn("Failed to validate subscription query")
 		return ErrorsFromGraphQLErrors(validation.Errors)
 	}
+	span.AddEvent("Validated query")
+
+	// Select the operation to run like executing the document would
+	operation, err := operationForDocument(document, subscription.OperationName)
+	if err != nil {
+		m.logger.WithField("err", err).Warn("Failed to select subscription operation")
+		return []error{err}
+	}
+
+	// Reject queries that are too deep or too expensive
+	limits := m.config.ComplexityLimits
+	if m.config.UserComplexityLimits != nil {
+		limits = m.config.UserComplexityLimits(conn.User())
+	}
+	if limits.MaxDepth > 0 || limits.MaxCost > 0 {
+		complexity := subscriptionComplexity(
+			m.schema,
+			document,
+			operation,
+			limits,
+		)
+		if errors := validateComplexity(complexity, limits); len(errors) > 0 {
+			m.logger.WithFields(LogFields{
+				"errors": errors,
+			}).Warn("Subscription query is too complex")
+			return errors
+		}
+	}
 
 	// Remember the query document for later
 	subscription.Document = document
 
-	// Extract query names from the document (typically, there should only be one)
-	subscription.Fields = subscriptionFieldNamesFromDocument(document)
+	// Extract the selected fields and their arguments from the operation
+	// in the document (typically, there should only be one field)
+	subscription.Selections = subscriptionFieldsFromDocument(
+		document,
+		operation,
+		subscription.Variables,
+	)
+	subscription.Fields = namesForSubscriptionFields(subscription.Selections)
+
+	// Attach the filters declared for the selected fields
+	for i := range subscription.Selections {
+		selection := &subscription.Selections[i]
+		selection.Filter = m.config.Filters[selection.Name]
+	}
+
+	// Check whether the subscription resumes from a cursor
+	var replay *subscriptionReplay
+	if m.config.EventStore != nil && m.config.ExecutionMode == PublishExecution {
+		cursor, resume, err := cursorForSubscription(subscription)
+		if err != nil {
+			m.logger.WithField("err", err).Warn("Failed to resume subscription")
+			return []error{err}
+		}
+		if resume {
+			replay = &subscriptionReplay{
+				cursor:   cursor,
+				replayed: make(map[string]uint64),
+				mutex:    &sync.Mutex{},
+			}
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Enforce the limits on the number of active subscriptions
+	userKey, hasUser := keyForUser(m.config.Limits.UserKey, conn.User())
+	if reason := m.exceededLimit(conn, userKey, hasUser); reason != "" {
+		m.logger.WithFields(LogFields{
+			"conn":         conn.ID(),
+			"subscription": subscription.ID,
+			"limit":        reason,
+		}).Warn("Too many subscriptions")
+		return []error{ErrTooManySubscriptions}
+	}
 
 	// Allocate the connection's map of subscription IDs to
 	// subscriptions on demand
@@ -152,15 +482,218 @@ func (m *subscriptionManager) AddSubscription(
 
 	// Add the subscription if it hasn't already been added
 	if m.subscriptions[conn][subscription.ID] != nil {
-		m.logger.WithFields(log.Fields{
+		m.logger.WithFields(LogFields{
 			"conn":         conn.ID(),
 			"subscription": subscription.ID,
 		}).Warn("Cannot register subscription twice")
 		return []error{errors.New("Cannot register subscription twice")}
 	}
 
+	// Hold back published events from resumed subscriptions until the
+	// events they missed are replayed
+	if replay != nil {
+		replay.mutex.Lock()
+		subscription.replay = replay
+	}
+
 	m.subscriptions[conn][subscription.ID] = subscription
+	m.index.add(subscription)
+	m.count++
+	for _, field := range subscription.Fields {
+		m.metrics.SubscriptionAdded(field)
+	}
+	span.AddEvent("Registered subscription")
+	if hasUser {
+		subscription.userKey = userKey
+		m.userCounts[userKey]++
+	}
+
+	return nil
+}
+
+// parseAndValidate parses a subscription query and validates it against
+// the schema, reusing cached results if a document cache is configured.
+func (m *subscriptionManager) parseAndValidate(
+	query string,
+) (*ast.Document, graphql.ValidationResult, error) {
+	cache := m.config.DocumentCache
+	if cache != nil {
+		if document, validation, ok := cache.get(m.schema, query); ok {
+			return document, validation, nil
+		}
+	}
+
+	document, err := parser.Parse(parser.ParseParams{
+		Source: query,
+	})
+	if err != nil {
+		return nil, graphql.ValidationResult{}, err
+	}
 
+	validation := graphql.ValidateDocument(m.schema, document, nil)
+
+	if cache != nil {
+		cache.add(m.schema, query, document, validation)
+	}
+
+	return document, validation, nil
+}
+
+// exceededLimit returns which subscription limit, if any, adding another
+// subscription for a connection would exceed.
+func (m *subscriptionManager) exceededLimit(
+	conn Connection,
+	userKey string,
+	hasUser bool,
+) string {
+	limits := m.config.Limits
+
+	if limits.MaxSubscriptions > 0 && m.count >= limits.MaxSubscriptions {
+		return "total"
+	}
+
+	if limits.MaxSubscriptionsPerConnection > 0 &&
+		len(m.subscriptions[conn]) >= limits.MaxSubscriptionsPerConnection {
+		return "connection"
+	}
+
+	if hasUser && limits.MaxSubscriptionsPerUser > 0 &&
+		m.userCounts[userKey] >= limits.MaxSubscriptionsPerUser {
+		return "user"
+	}
+
+	return ""
+}
+
+func (m *subscriptionManager) executeSubscription(
+	conn Connection,
+	subscription *Subscription,
+) {
+	ctx := context.Background()
+	if m.config.Context != nil {
+		ctx = m.config.Context(conn)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, executionTimerKey{}, subscription)
+
+	// Only execute the subscription if it wasn't removed while building
+	// its context; otherwise, removing it could not cancel the execution
+	m.mutex.Lock()
+	registered := m.subscriptions[conn][subscription.ID] == subscription
+	if registered {
+		subscription.cancel = cancel
+	}
+	m.mutex.Unlock()
+	if !registered {
+		cancel()
+		return
+	}
+
+	results := graphql.ExecuteSubscription(graphql.ExecuteParams{
+		Schema:        m.resolving,
+		Root:          m.config.RootValue,
+		AST:           subscription.Document,
+		OperationName: subscription.OperationName,
+		Args:          subscription.Variables,
+		Context:       ctx,
+	})
+
+	go func() {
+		// Send every result to the client until the source event stream
+		// is closed; results produced after the subscription was stopped
+		// are drained but dropped, as the client is no longer interested
+		for result := range results {
+			if ctx.Err() != nil {
+				continue
+			}
+
+			_, span := m.tracer.Start(ctx, "graphqlws.deliver", SpanOptions{
+				Link:       subscription.span,
+				Attributes: subscriptionAttributes(conn, subscription),
+			})
+			errs := ErrorsFromGraphQLErrors(result.Errors)
+			subscription.SendData(&DataMessagePayload{
+				Data:   result.Data,
+				Errors: errs,
+			})
+			span.End(errs...)
+		}
+
+		// If the stream was closed by the subscribe resolver rather than
+		// the client stopping the subscription, notify the client that the
+		// subscription has completed and unregister it
+		if ctx.Err() == nil {
+			m.logger.WithFields(LogFields{
+				"conn":         conn.ID(),
+				"subscription": subscription.ID,
+			}).Debug("Subscription completed")
+
+			m.mutex.Lock()
+			registered := m.subscriptions[conn][subscription.ID] == subscription
+			if registered {
+				m.removeSubscription(conn, subscription.ID)
+			}
+			m.mutex.Unlock()
+
+			sendComplete(conn, subscription.ID)
+			if registered && subscription.Complete != nil {
+				subscription.Complete()
+			}
+		}
+
+		cancel()
+	}()
+}
+
+type executionTimerKey struct{}
+
+// executionTimer is a GraphQL extension reporting how long executing a
+// subscription for an event of its source stream takes, for the fields
+// of the subscription in the context of the execution.
+type executionTimer struct {
+	metrics Metrics
+}
+
+func (t *executionTimer) Init(ctx context.Context, _ *graphql.Params) context.Context {
+	return ctx
+}
+
+func (t *executionTimer) Name() string {
+	return "graphqlws.executionTimer"
+}
+
+func (t *executionTimer) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	return ctx, func(error) {}
+}
+
+func (t *executionTimer) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	return ctx, func([]gqlerrors.FormattedError) {}
+}
+
+func (t *executionTimer) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	subscription, ok := ctx.Value(executionTimerKey{}).(*Subscription)
+	if !ok {
+		return ctx, func(*graphql.Result) {}
+	}
+
+	start := time.Now()
+	return ctx, func(*graphql.Result) {
+		duration := time.Since(start)
+		for _, field := range subscription.Fields {
+			t.metrics.ExecutionCompleted(field, duration)
+		}
+	}
+}
+
+func (t *executionTimer) ResolveFieldDidStart(ctx context.Context, _ *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {}
+}
+
+func (t *executionTimer) HasResult() bool {
+	return false
+}
+
+func (t *executionTimer) GetResult(context.Context) interface{} {
 	return nil
 }
 
@@ -168,13 +701,42 @@ func (m *subscriptionManager) RemoveSubscription(
 	conn Connection,
 	subscription *Subscription,
 ) {
-	m.logger.WithFields(log.Fields{
+	m.logger.WithFields(LogFields{
 		"conn":         conn.ID(),
 		"subscription": subscription.ID,
 	}).Info("Remove subscription")
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.removeSubscription(conn, subscription.ID)
+}
+
+func (m *subscriptionManager) removeSubscription(conn Connection, id string) {
+	// Remove the subscription from the field index; the subscription
+	// passed in by callers may only carry an ID, so use the registered one
+	if registered := m.subscriptions[conn][id]; registered != nil {
+		m.index.remove(registered)
+		for _, field := range registered.Fields {
+			m.metrics.SubscriptionRemoved(field)
+		}
+
+		// Stop the source event stream of the subscription, if any
+		if registered.cancel != nil {
+			registered.cancel()
+		}
+
+		m.count--
+		if registered.userKey != "" {
+			m.userCounts[registered.userKey]--
+			if m.userCounts[registered.userKey] <= 0 {
+				delete(m.userCounts, registered.userKey)
+			}
+		}
+	}
+
 	// Remove the subscription from its connections' subscription map
-	delete(m.subscriptions[conn], subscription.ID)
+	delete(m.subscriptions[conn], id)
 
 	// Remove the connection as well if there are no subscriptions left
 	if len(m.subscriptions[conn]) == 0 {
@@ -183,15 +745,18 @@ func (m *subscriptionManager) RemoveSubscription(
 }
 
 func (m *subscriptionManager) RemoveSubscriptions(conn Connection) {
-	m.logger.WithFields(log.Fields{
+	m.logger.WithFields(LogFields{
 		"conn": conn.ID(),
 	}).Info("Remove subscriptions")
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	// Only remove subscriptions if we know the connection
 	if m.subscriptions[conn] != nil {
 		// Remove subscriptions one by one
 		for opID := range m.subscriptions[conn] {
-			m.RemoveSubscription(conn, m.subscriptions[conn][opID])
+			m.removeSubscription(conn, opID)
 		}
 
 		// Remove the connection's subscription map altogether
@@ -199,6 +764,133 @@ func (m *subscriptionManager) RemoveSubscriptions(conn Connection) {
 	}
 }
 
+func (m *subscriptionManager) SubscriptionsForField(
+	field string,
+	args map[string]interface{},
+) []*Subscription {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.index.lookup(field, args)
+}
+
+func (m *subscriptionManager) Publish(
+	ctx context.Context,
+	field string,
+	event interface{},
+) {
+	// Record the event for subscriptions resumed later on
+	var sequence uint64
+	if m.config.EventStore != nil {
+		var err error
+		sequence, err = m.config.EventStore.Append(field, event)
+		if err != nil {
+			m.logger.WithFields(LogFields{
+				"field": field,
+				"err":   err,
+			}).Warn("Failed to record event")
+		}
+	}
+
+	// Subscriptions that execute the same operation receive the same
+	// result, which is only executed and encoded once
+	results := make(map[string]*DataMessagePayload)
+
+	for _, subscription := range m.SubscriptionsForField(field, nil) {
+		if !subscription.Accepts(field, event) {
+			continue
+		}
+
+		// Wait for events to be replayed to resumed subscriptions and
+		// skip those that were part of the replay
+		if replay := subscription.replay; replay != nil {
+			replay.mutex.Lock()
+			skip := replay.skips(field, sequence)
+			if !skip {
+				m.execute(ctx, subscription, field, event, sequence, results)
+			}
+			replay.mutex.Unlock()
+			continue
+		}
+
+		m.execute(ctx, subscription, field, event, sequence, results)
+	}
+}
+
+// execute executes a subscription with an event published for a field
+// and sends the result to the subscriber, along with the cursor of the
+// event if it was recorded. If results is not nil, results are shared
+// with (and taken from) other subscriptions executing the same operation.
+func (m *subscriptionManager) execute(
+	ctx context.Context,
+	subscription *Subscription,
+	field string,
+	event interface{},
+	sequence uint64,
+	results map[string]*DataMessagePayload,
+) {
+	m.logger.WithFields(LogFields{
+		"conn":         subscription.Connection.ID(),
+		"subscription": subscription.ID,
+		"field":        field,
+	}).Debug("Execute subscription")
+
+	// Trace executing and delivering the result as part of publishing
+	// the event, linked to the trace of starting the subscription
+	spanCtx, span := m.tracer.Start(ctx, "graphqlws.execute", SpanOptions{
+		Link: subscription.span,
+		Attributes: append(
+			subscriptionAttributes(subscription.Connection, subscription),
+			SpanAttribute{Key: fieldKey, Value: field},
+		),
+	})
+
+	key := ""
+	if results != nil {
+		key = resultKey(subscription)
+	}
+
+	payload, ok := results[key]
+	if !ok || key == "" {
+		start := time.Now()
+		result := graphql.Execute(graphql.ExecuteParams{
+			Schema:        *m.schema,
+			Root:          event,
+			AST:           subscription.Document,
+			OperationName: subscription.OperationName,
+			Args:          subscription.Variables,
+			Context:       spanCtx,
+		})
+		m.metrics.ExecutionCompleted(field, time.Since(start))
+
+		payload = &DataMessagePayload{
+			Data:       result.Data,
+			Errors:     ErrorsFromGraphQLErrors(result.Errors),
+			Extensions: cursorExtensions(sequence),
+		}
+
+		// Encode shared results before they are sent anywhere, as
+		// connections encode the messages they send concurrently
+		if key != "" && payload.Encode() == nil {
+			results[key] = payload
+		}
+	}
+
+	subscription.SendData(payload)
+	span.End(payload.Errors...)
+}
+
+// resultKey identifies the operation a subscription executes for
+// published events, or returns an empty string if its variables cannot
+// be encoded.
+func resultKey(subscription *Subscription) string {
+	variables, err := json.Marshal(subscription.Variables)
+	if err != nil {
+		return ""
+	}
+	return subscription.OperationName + "\x00" + subscription.Query + "\x00" + string(variables)
+}
+
 func validateSubscription(s *Subscription) []error {
 	errs := []error{}
 
@@ -1,24 +1,38 @@
 package graphqlws_test
 
 import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/functionalfoundry/graphqlws"
+	graphqlwsprometheus "github.com/functionalfoundry/graphqlws/prometheus"
 	"github.com/graphql-go/graphql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
 )
 
 // Mock connection
 
 type mockWebSocketConnection struct {
-	user string
-	id   string
+	user      string
+	id        string
+	completed chan string
 }
 
 func (c *mockWebSocketConnection) ID() string {
 	return c.id
 }
 
+func (c *mockWebSocketConnection) Context() context.Context {
+	return context.Background()
+}
+
 func (c *mockWebSocketConnection) User() interface{} {
 	return c.user
 }
@@ -34,10 +48,17 @@ func (c *mockWebSocketConnection) SendError(err error) {
 	// Do nothing
 }
 
+func (c *mockWebSocketConnection) SendComplete(opID string) {
+	if c.completed != nil {
+		c.completed <- opID
+	}
+}
+
 // Tests
 
 func TestMain(m *testing.M) {
 	log.SetLevel(log.ErrorLevel)
+	os.Exit(m.Run())
 }
 
 func TestSubscriptions_NewSubscriptionManagerCreatesInstance(t *testing.T) {
@@ -336,3 +357,1115 @@ func TestSubscriptions_RemovingSubscriptionsOfAConnectionWorks(t *testing.T) {
 		t.Error("RemoveSubscriptions doesn't remove subscriptions of connections")
 	}
 }
+
+func TestSubscriptions_SubscriptionsCanBeIteratedWhileAddingSubscriptions(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+
+	conn := mockWebSocketConnection{id: "1"}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			sm.AddSubscription(&conn, &graphqlws.Subscription{
+				ID:         strconv.Itoa(i),
+				Connection: &conn,
+				Query:      "subscription { users }",
+				SendData:   func(*graphqlws.DataMessagePayload) {},
+			})
+		}
+	}()
+
+	// Subscriptions returns snapshots that aren't modified while the
+	// caller iterates over them
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, subscriptions := range sm.Subscriptions() {
+			for range subscriptions {
+			}
+		}
+	}
+
+	if len(sm.Subscriptions()[&conn]) != 100 {
+		t.Error("Subscriptions are not added:", len(sm.Subscriptions()[&conn]))
+	}
+}
+
+func TestSubscriptions_SubscriptionsForFieldUsesFieldsAndArguments(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+				"messages": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+					Args: graphql.FieldConfigArgument{
+						"roomId": &graphql.ArgumentConfig{
+							Type: graphql.Int,
+						},
+					},
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManager(&schema)
+
+	conn := mockWebSocketConnection{id: "1"}
+
+	// Add subscriptions to different fields and with different arguments
+	sub1 := graphqlws.Subscription{
+		ID:         "1",
+		Connection: &conn,
+		Query:      "subscription { users }",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	}
+	sm.AddSubscription(&conn, &sub1)
+	sub2 := graphqlws.Subscription{
+		ID:         "2",
+		Connection: &conn,
+		Query:      "subscription { messages(roomId: 1) }",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	}
+	sm.AddSubscription(&conn, &sub2)
+	sub3 := graphqlws.Subscription{
+		ID:         "3",
+		Connection: &conn,
+		Query:      "subscription ($room: Int) { messages(roomId: $room) }",
+		Variables:  map[string]interface{}{"room": float64(2)},
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	}
+	sm.AddSubscription(&conn, &sub3)
+
+	if subs := sm.SubscriptionsForField("users", nil); len(subs) != 1 || subs[0] != &sub1 {
+		t.Error("SubscriptionsForField doesn't return subscriptions of a field")
+	}
+
+	if subs := sm.SubscriptionsForField("messages", nil); len(subs) != 2 {
+		t.Error("SubscriptionsForField doesn't return all subscriptions of a field")
+	}
+
+	subs := sm.SubscriptionsForField("messages", map[string]interface{}{"roomId": 2})
+	if len(subs) != 1 || subs[0] != &sub3 {
+		t.Error("SubscriptionsForField doesn't match arguments set through variables")
+	}
+
+	subs = sm.SubscriptionsForField("messages", map[string]interface{}{"roomId": 3})
+	if len(subs) != 0 {
+		t.Error("SubscriptionsForField returns subscriptions with other arguments")
+	}
+
+	if subs := sm.SubscriptionsForField("foo", nil); len(subs) != 0 {
+		t.Error("SubscriptionsForField returns subscriptions for unknown fields")
+	}
+
+	// Verify that removed subscriptions are no longer returned
+	sm.RemoveSubscription(&conn, &graphqlws.Subscription{ID: "2"})
+
+	subs = sm.SubscriptionsForField("messages", map[string]interface{}{"roomId": 1})
+	if len(subs) != 0 {
+		t.Error("SubscriptionsForField returns removed subscriptions")
+	}
+
+	sm.RemoveSubscriptions(&conn)
+
+	if subs := sm.SubscriptionsForField("users", nil); len(subs) != 0 {
+		t.Error("SubscriptionsForField returns subscriptions of removed connections")
+	}
+}
+
+func TestSubscriptions_FieldsAreExtractedFromFragmentsAndOperations(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+				"messages": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+					Args: graphql.FieldConfigArgument{
+						"roomId": &graphql.ArgumentConfig{
+							Type: graphql.Int,
+						},
+					},
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManager(&schema)
+
+	conn := mockWebSocketConnection{id: "1"}
+
+	// Add a subscription selecting fields through fragments and aliases
+	sub := graphqlws.Subscription{
+		ID:         "1",
+		Connection: &conn,
+		Query: `
+			subscription Users { users }
+			subscription Messages($room: Int = 7) {
+				...RoomMessages
+				... on Subscription { users }
+			}
+			fragment RoomMessages on Subscription {
+				room: messages(roomId: $room)
+			}`,
+		OperationName: "Messages",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	}
+	if errors := sm.AddSubscription(&conn, &sub); len(errors) > 0 {
+		t.Fatal("AddSubscription fails adding valid subscriptions:", errors)
+	}
+
+	if len(sub.Selections) != 2 {
+		t.Fatal("AddSubscription doesn't extract all fields:", sub.Selections)
+	}
+
+	messages := sub.Selections[0]
+	if messages.Name != "messages" ||
+		messages.Alias != "room" ||
+		messages.Arguments["roomId"] != 7 {
+		t.Error("AddSubscription doesn't extract fields from fragments:", messages)
+	}
+
+	users := sub.Selections[1]
+	if users.Name != "users" || users.Alias != "users" {
+		t.Error("AddSubscription doesn't extract fields from inline fragments:", users)
+	}
+
+	if !sub.MatchesField("messages") || !sub.MatchesField("users") {
+		t.Error("MatchesField doesn't match fields selected through fragments")
+	}
+
+	subs := sm.SubscriptionsForField("messages", map[string]interface{}{"roomId": 7})
+	if len(subs) != 1 || subs[0] != &sub {
+		t.Error("SubscriptionsForField doesn't match default variable values")
+	}
+}
+
+func TestSubscriptions_OperationsMustBeSelectedUnambiguously(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManager(&schema)
+	conn := mockWebSocketConnection{id: "1"}
+
+	add := func(id string, operationName string) []error {
+		return sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:            id,
+			Connection:    &conn,
+			Query:         "subscription A { users } subscription B { users }",
+			OperationName: operationName,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+
+	if errors := add("1", ""); len(errors) == 0 {
+		t.Error("AddSubscription accepts documents with several operations without a name")
+	}
+	if errors := add("2", "C"); len(errors) == 0 {
+		t.Error("AddSubscription accepts unknown operation names")
+	}
+	if errors := add("3", "B"); len(errors) > 0 {
+		t.Fatal("AddSubscription fails adding named operations:", errors)
+	}
+	if subs := sm.SubscriptionsForField("users", nil); len(subs) != 1 {
+		t.Error("Subscriptions are not indexed by the fields of their operation:", subs)
+	}
+}
+
+func TestSubscriptions_PublishSkipsSubscribersRejectedByFilters(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"message": &graphql.Field{
+					Type: graphql.String,
+					Args: graphql.FieldConfigArgument{
+						"roomId": &graphql.ArgumentConfig{
+							Type: graphql.String,
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source.(map[string]string)["text"], nil
+					},
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema: &schema,
+			Filters: map[string]graphqlws.SubscriptionFilterFunc{
+				"message": func(
+					event interface{},
+					args map[string]interface{},
+					user interface{},
+				) bool {
+					return event.(map[string]string)["roomId"] == args["roomId"] &&
+						user != "banned"
+				},
+			},
+		},
+	)
+
+	conn1 := mockWebSocketConnection{id: "1", user: "joe"}
+	conn2 := mockWebSocketConnection{id: "2", user: "banned"}
+
+	// Subscribe to two different rooms and to the same room as a banned user
+	received := map[string][]interface{}{}
+	subscribe := func(conn *mockWebSocketConnection, id string, room string) {
+		errors := sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: conn,
+			Query:      `subscription ($room: String) { message(roomId: $room) }`,
+			Variables:  map[string]interface{}{"room": room},
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				received[id] = append(received[id], msg.Data)
+			},
+		})
+		if len(errors) > 0 {
+			t.Fatal("AddSubscription fails adding valid subscriptions:", errors)
+		}
+	}
+	subscribe(&conn1, "a", "1")
+	subscribe(&conn1, "b", "2")
+	subscribe(&conn2, "c", "1")
+
+	sm.Publish(context.Background(), "message", map[string]string{
+		"roomId": "1",
+		"text":   "hello",
+	})
+
+	if len(received["a"]) != 1 {
+		t.Fatal("Publish doesn't send data to subscribers accepted by filters")
+	}
+	data, _ := received["a"][0].(map[string]interface{})
+	if data["message"] != "hello" {
+		t.Error("Publish doesn't execute subscriptions with the event:", data)
+	}
+	if len(received["b"]) != 0 || len(received["c"]) != 0 {
+		t.Error("Publish sends data to subscribers rejected by filters")
+	}
+}
+
+func TestSubscriptions_PublishSharesResultsOfTheSameOperation(t *testing.T) {
+	executions := 0
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"message": &graphql.Field{
+					Type: graphql.String,
+					Args: graphql.FieldConfigArgument{
+						"roomId": &graphql.ArgumentConfig{
+							Type: graphql.String,
+						},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						executions++
+						return p.Source.(string) + " " + p.Args["roomId"].(string), nil
+					},
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManager(&schema)
+
+	conn1 := mockWebSocketConnection{id: "1", user: "joe"}
+	conn2 := mockWebSocketConnection{id: "2", user: "jane"}
+
+	// Subscribe to the same room from two connections and to another room
+	received := map[string]*graphqlws.DataMessagePayload{}
+	subscribe := func(conn *mockWebSocketConnection, id string, room string) {
+		errors := sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: conn,
+			Query:      `subscription ($room: String) { message(roomId: $room) }`,
+			Variables:  map[string]interface{}{"room": room},
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				received[id] = msg
+			},
+		})
+		if len(errors) > 0 {
+			t.Fatal("AddSubscription fails adding valid subscriptions:", errors)
+		}
+	}
+	subscribe(&conn1, "a", "1")
+	subscribe(&conn2, "b", "1")
+	subscribe(&conn2, "c", "2")
+
+	sm.Publish(context.Background(), "message", "hello")
+
+	if executions != 2 {
+		t.Error("Publish doesn't execute each operation once:", executions)
+	}
+	if received["a"] == nil || received["a"] != received["b"] {
+		t.Fatal("Publish doesn't share results of the same operation:", received)
+	}
+	if string(received["a"].Encoded) != `{"data":{"message":"hello 1"},"errors":null}` {
+		t.Error("Shared results are not encoded:", string(received["a"].Encoded))
+	}
+	data, _ := received["c"].Data.(map[string]interface{})
+	if data["message"] != "hello 2" {
+		t.Error("Publish shares results of different operations:", data)
+	}
+}
+
+func TestSubscriptions_ResolverExecutionPumpsEventsUntilCompletion(t *testing.T) {
+	events := make(chan interface{})
+	stopped := make(chan bool, 1)
+
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"counter": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+					Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+						go func() {
+							<-p.Context.Done()
+							stopped <- true
+						}()
+						return events, nil
+					},
+				},
+			},
+		})})
+	metrics := graphqlwsprometheus.NewMetrics("")
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:        &schema,
+			ExecutionMode: graphqlws.ResolverExecution,
+			Metrics:       metrics,
+		},
+	)
+
+	conn := mockWebSocketConnection{id: "1", completed: make(chan string, 1)}
+
+	received := make(chan interface{}, 1)
+	sub := graphqlws.Subscription{
+		ID:         "1",
+		Connection: &conn,
+		Query:      "subscription { counter }",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			received <- msg.Data
+		},
+	}
+	if errors := sm.AddSubscription(&conn, &sub); len(errors) > 0 {
+		t.Fatal("AddSubscription fails adding valid subscriptions:", errors)
+	}
+
+	// Verify that events from the subscribe resolver are executed and sent
+	events <- 1
+	select {
+	case data := <-received:
+		if data.(map[string]interface{})["counter"] != 1 {
+			t.Error("Subscription events are not executed properly:", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscription events are not sent to the subscriber")
+	}
+	if testutil.CollectAndCount(metrics, "graphqlws_execution_duration_seconds") != 1 {
+		t.Error("Executing subscription events is not reported")
+	}
+
+	// Verify that closing the event stream completes the subscription
+	close(events)
+	select {
+	case id := <-conn.completed:
+		if id != "1" {
+			t.Error("The wrong subscription was completed:", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscriptions are not completed when their event stream closes")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("The source event stream is not cancelled after completion")
+	}
+
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("Completed subscriptions are not removed")
+	}
+}
+
+func TestSubscriptions_ResolverExecutionIsCancelledWhenStopped(t *testing.T) {
+	stopped := make(chan bool, 1)
+
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"counter": &graphql.Field{
+					Type: graphql.Int,
+					Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+						events := make(chan interface{})
+						go func() {
+							<-p.Context.Done()
+							stopped <- true
+							close(events)
+						}()
+						return events, nil
+					},
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:        &schema,
+			ExecutionMode: graphqlws.ResolverExecution,
+		},
+	)
+
+	conn := mockWebSocketConnection{id: "1", completed: make(chan string, 1)}
+
+	sub := graphqlws.Subscription{
+		ID:         "1",
+		Connection: &conn,
+		Query:      "subscription { counter }",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	}
+	if errors := sm.AddSubscription(&conn, &sub); len(errors) > 0 {
+		t.Fatal("AddSubscription fails adding valid subscriptions:", errors)
+	}
+
+	sm.RemoveSubscription(&conn, &graphqlws.Subscription{ID: "1"})
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("The source event stream is not cancelled when stopping")
+	}
+
+	select {
+	case <-conn.completed:
+		t.Error("Stopped subscriptions are completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscriptions_ResolverExecutionContextsCanUseTheManager(t *testing.T) {
+	events := make(chan interface{}, 1)
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"counter": &graphql.Field{
+					Type: graphql.Int,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+					Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+						return events, nil
+					},
+				},
+			},
+		})})
+
+	// Build contexts from what the manager knows about the connection
+	var sm graphqlws.SubscriptionManager
+	sm = graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:        &schema,
+			ExecutionMode: graphqlws.ResolverExecution,
+			Context: func(conn graphqlws.Connection) context.Context {
+				sm.Subscriptions()
+				return context.Background()
+			},
+		},
+	)
+
+	conn := mockWebSocketConnection{id: "1", completed: make(chan string, 1)}
+	received := make(chan interface{}, 1)
+	added := make(chan []error, 1)
+	go func() {
+		added <- sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         "1",
+			Connection: &conn,
+			Query:      "subscription { counter }",
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				received <- msg.Data
+			},
+		})
+	}()
+
+	select {
+	case errors := <-added:
+		if len(errors) > 0 {
+			t.Fatal("AddSubscription fails adding valid subscriptions:", errors)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Building the context of a subscription blocks the manager")
+	}
+
+	events <- 1
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("Subscription events are not sent to the subscriber")
+	}
+	sm.RemoveSubscriptions(&conn)
+}
+
+func TestSubscriptions_PersistedQueriesAreResolvedAndEnforced(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:                    &schema,
+			PersistedQueries:          graphqlws.NewPersistedQueries("subscription { users }"),
+			AllowPersistedQueriesOnly: true,
+		},
+	)
+
+	conn := mockWebSocketConnection{id: "1"}
+
+	// Add a subscription referring to a persisted query in Apollo's format
+	sub1 := graphqlws.Subscription{
+		ID:         "1",
+		Connection: &conn,
+		Extensions: map[string]interface{}{
+			"persistedQuery": map[string]interface{}{
+				"version":    1,
+				"sha256Hash": graphqlws.PersistedQueryID("subscription { users }"),
+			},
+		},
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	}
+	if errors := sm.AddSubscription(&conn, &sub1); len(errors) > 0 {
+		t.Fatal("AddSubscription fails adding persisted queries:", errors)
+	}
+	if sub1.Query != "subscription { users }" || !sub1.MatchesField("users") {
+		t.Error("AddSubscription doesn't resolve persisted queries")
+	}
+
+	// Add a subscription with an allowed query string
+	errors := sm.AddSubscription(&conn, &graphqlws.Subscription{
+		ID:         "2",
+		Connection: &conn,
+		Query:      "subscription { users }",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	})
+	if len(errors) > 0 {
+		t.Error("AddSubscription fails adding allowed queries:", errors)
+	}
+
+	// Try adding a subscription with an unknown persisted query ID
+	errors = sm.AddSubscription(&conn, &graphqlws.Subscription{
+		ID:               "3",
+		Connection:       &conn,
+		PersistedQueryID: "unknown",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	})
+	if len(errors) != 1 || errors[0].Error() != "PersistedQueryNotFound" {
+		t.Error("AddSubscription doesn't fail adding unknown persisted queries")
+	}
+
+	// Try adding a subscription with a query that's not in the allowlist
+	errors = sm.AddSubscription(&conn, &graphqlws.Subscription{
+		ID:         "4",
+		Connection: &conn,
+		Query:      "subscription { users __typename }",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	})
+	if len(errors) == 0 {
+		t.Error("AddSubscription doesn't fail adding queries not in the allowlist")
+	}
+
+	if len(sm.Subscriptions()[&conn]) != 2 {
+		t.Fatal("AddSubscription unexpectedly adds rejected subscriptions")
+	}
+}
+
+// registeringQueryStore is a persisted query store that clients can
+// register queries with
+type registeringQueryStore struct {
+	graphqlws.PersistedQueries
+}
+
+func (store registeringQueryStore) Register(id string, query string) {
+	store.PersistedQueries[id] = query
+}
+
+func TestSubscriptions_PersistedQueriesAreRegisteredByClients(t *testing.T) {
+	schema := newTestSchema()
+	store := registeringQueryStore{graphqlws.NewPersistedQueries()}
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:           &schema,
+			PersistedQueries: store,
+		},
+	)
+
+	conn := mockWebSocketConnection{id: "1"}
+	add := func(id string, query string, hash string) []error {
+		return sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      query,
+			Extensions: map[string]interface{}{
+				"persistedQuery": map[string]interface{}{
+					"version":    1,
+					"sha256Hash": hash,
+				},
+			},
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+	hash := graphqlws.PersistedQueryID("subscription { users }")
+
+	// Refer to the query before it is registered
+	errors := add("1", "", hash)
+	if len(errors) != 1 || errors[0].Error() != "PersistedQueryNotFound" {
+		t.Error("AddSubscription doesn't fail adding unknown persisted queries:", errors)
+	}
+
+	// Try registering the query under the wrong hash
+	if errors := add("2", "subscription { users __typename }", hash); len(errors) == 0 {
+		t.Error("AddSubscription accepts queries that don't match their hash")
+	}
+
+	// Register the query, then refer to it by its hash only
+	if errors := add("3", "subscription { users }", hash); len(errors) > 0 {
+		t.Fatal("AddSubscription fails registering queries:", errors)
+	}
+	if errors := add("4", "", hash); len(errors) > 0 {
+		t.Error("AddSubscription fails adding registered queries:", errors)
+	}
+
+	if len(sm.Subscriptions()[&conn]) != 2 {
+		t.Fatal("AddSubscription unexpectedly adds rejected subscriptions")
+	}
+}
+
+func TestSubscriptions_DocumentCacheReusesParsedQueries(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+				"messages": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		})})
+	cache := graphqlws.NewDocumentCache(1)
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:        &schema,
+			DocumentCache: cache,
+		},
+	)
+
+	conn := mockWebSocketConnection{id: "1"}
+
+	subscribe := func(id string, query string) *graphqlws.Subscription {
+		sub := graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      query,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		}
+		sm.AddSubscription(&conn, &sub)
+		return &sub
+	}
+
+	sub1 := subscribe("1", "subscription { users }")
+	sub2 := subscribe("2", "subscription { users }")
+
+	if sub1.Document != sub2.Document {
+		t.Error("Identical queries are not parsed only once")
+	}
+
+	// Exceed the cache size, evicting the first query
+	subscribe("3", "subscription { messages }")
+	subscribe("4", "subscription { users }")
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Entries != 1 {
+		t.Error("DocumentCache doesn't evict the least recently used queries:", stats)
+	}
+
+	// Verify that invalid queries are rejected when cached as well
+	for _, id := range []string{"5", "6"} {
+		errors := sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      "subscription { foo }",
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+		if len(errors) == 0 {
+			t.Error("AddSubscription doesn't fail adding cached invalid queries")
+		}
+	}
+}
+
+func TestSubscriptions_ComplexQueriesAreRejected(t *testing.T) {
+	user := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{
+				Type: graphql.String,
+			},
+		},
+	})
+	user.AddFieldConfig("friends", &graphql.Field{
+		Type: graphql.NewList(user),
+	})
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"me": &graphql.Field{
+					Type: user,
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(user),
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema: &schema,
+			UserComplexityLimits: func(user interface{}) graphqlws.ComplexityLimits {
+				limits := graphqlws.ComplexityLimits{
+					MaxDepth:       3,
+					MaxCost:        20,
+					FieldCosts:     map[string]int{"User.friends": 2},
+					ListMultiplier: 3,
+				}
+				if user == "admin" {
+					limits.MaxDepth = 0
+					limits.MaxCost = 0
+				}
+				return limits
+			},
+		},
+	)
+
+	conn := mockWebSocketConnection{id: "1", user: "joe"}
+	admin := mockWebSocketConnection{id: "2", user: "admin"}
+
+	subscribe := func(conn *mockWebSocketConnection, id, query string) []error {
+		return sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: conn,
+			Query:      query,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+
+	// users (1) + 3 * (name (1) + friends (2) + 3 * name (1)) = 19
+	errors := subscribe(&conn, "1", `
+		subscription { users { ...User } }
+		fragment User on User { name friends { name } }`)
+	if len(errors) > 0 {
+		t.Error("AddSubscription rejects queries within the limits:", errors)
+	}
+
+	// users (1) + 3 * (friends (2) + 3 * (name (1) + __typename (0))) = 16
+	errors = subscribe(&conn, "2", `subscription { users { friends { name __typename } } }`)
+	if len(errors) > 0 {
+		t.Error("AddSubscription rejects queries within the limits:", errors)
+	}
+
+	// users (1) + 3 * (friends (2) + 3 * (friends (2) + 3 * name (1))) = 52
+	errors = subscribe(&conn, "3", `subscription { users { friends { friends { name } } } }`)
+	if len(errors) != 2 {
+		t.Error("AddSubscription doesn't reject queries exceeding the limits:", errors)
+	}
+
+	// Verify that user-specific limits are applied
+	errors = subscribe(&admin, "3", `subscription { users { friends { friends { name } } } }`)
+	if len(errors) > 0 {
+		t.Error("AddSubscription doesn't apply user-specific limits:", errors)
+	}
+}
+
+func TestSubscriptions_SubscriptionLimitsAreEnforced(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		})})
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema: &schema,
+			Limits: graphqlws.SubscriptionLimits{
+				MaxSubscriptions:              4,
+				MaxSubscriptionsPerConnection: 2,
+				MaxSubscriptionsPerUser:       3,
+			},
+		},
+	)
+
+	conn1 := mockWebSocketConnection{id: "1", user: "joe"}
+	conn2 := mockWebSocketConnection{id: "2", user: "joe"}
+	conn3 := mockWebSocketConnection{id: "3", user: "jane"}
+
+	subscribe := func(conn *mockWebSocketConnection, id string) []error {
+		return sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: conn,
+			Query:      "subscription { users }",
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+
+	subscribe(&conn1, "1")
+	subscribe(&conn1, "2")
+
+	// Verify the per-connection limit
+	if errors := subscribe(&conn1, "3"); len(errors) != 1 ||
+		errors[0] != graphqlws.ErrTooManySubscriptions {
+		t.Error("AddSubscription doesn't enforce the per-connection limit")
+	}
+
+	// Verify the per-user limit
+	if errors := subscribe(&conn2, "1"); len(errors) > 0 {
+		t.Error("AddSubscription rejects subscriptions within the limits:", errors)
+	}
+	if errors := subscribe(&conn2, "2"); len(errors) == 0 {
+		t.Error("AddSubscription doesn't enforce the per-user limit")
+	}
+
+	// Verify the total limit
+	if errors := subscribe(&conn3, "1"); len(errors) > 0 {
+		t.Error("AddSubscription rejects subscriptions within the limits:", errors)
+	}
+	if errors := subscribe(&conn3, "2"); len(errors) == 0 {
+		t.Error("AddSubscription doesn't enforce the total limit")
+	}
+
+	// Verify that removing subscriptions frees up capacity
+	sm.RemoveSubscriptions(&conn1)
+	if errors := subscribe(&conn2, "2"); len(errors) > 0 {
+		t.Error("AddSubscription doesn't free up capacity on removal:", errors)
+	}
+	if errors := subscribe(&conn3, "2"); len(errors) > 0 {
+		t.Error("AddSubscription doesn't free up capacity on removal:", errors)
+	}
+}
+
+func TestSubscriptions_ConfiguredLoggerIsUsed(t *testing.T) {
+	schema := newTestSchema()
+
+	buffer := &bytes.Buffer{}
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema: &schema,
+		Logger: graphqlws.NewSlogLogger(slog.New(slog.NewTextHandler(buffer, nil))),
+	})
+
+	conn := mockWebSocketConnection{id: "1"}
+	sm.AddSubscription(&conn, &graphqlws.Subscription{
+		ID:         "1",
+		Connection: &conn,
+		Query:      "subscription { users }",
+		SendData: func(msg *graphqlws.DataMessagePayload) {
+			// Do nothing
+		},
+	})
+
+	output := buffer.String()
+	if !strings.Contains(output, `msg="Add subscription"`) ||
+		!strings.Contains(output, "prefix=graphqlws/subscriptions") ||
+		!strings.Contains(output, "subscription=1") {
+		t.Error("Messages are not logged through the configured logger:", output)
+	}
+}
+
+func TestSubscriptions_ResumedSubscriptionsReplayMissedEvents(t *testing.T) {
+	schema := newTestSchema()
+	sm := graphqlws.NewSubscriptionManagerWithConfig(
+		graphqlws.SubscriptionManagerConfig{
+			Schema:     &schema,
+			EventStore: graphqlws.NewMemoryEventStore(2),
+		},
+	)
+
+	publish := func(user string) {
+		sm.Publish(context.Background(), "users", map[string]interface{}{
+			"users": []string{user},
+		})
+	}
+
+	conn := mockWebSocketConnection{id: "1"}
+	received := []string{}
+	subscribe := func(id string, cursor interface{}) []error {
+		return sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      "subscription { users }",
+			Extensions: map[string]interface{}{"cursor": cursor},
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				users := msg.Data.(map[string]interface{})["users"].([]interface{})
+				received = append(received, users[0].(string)+"@"+msg.Extensions["cursor"].(string))
+			},
+		})
+	}
+
+	// Publish events without subscribers; only the last two are retained
+	publish("jane")
+	publish("joe")
+	publish("jim")
+
+	// Verify that the retained events since the cursor are replayed
+	if errors := subscribe("1", "1"); len(errors) > 0 {
+		t.Fatal("Failed to resume subscription:", errors)
+	}
+	if strings.Join(received, ",") != "joe@2,jim@3" {
+		t.Error("Missed events are not replayed:", received)
+	}
+
+	// Verify that new events are delivered along with their cursor
+	publish("jill")
+	if strings.Join(received, ",") != "joe@2,jim@3,jill@4" {
+		t.Error("New events are not delivered after the replay:", received)
+	}
+
+	// Verify that subscriptions cannot be resumed from evicted events
+	if errors := subscribe("2", float64(0)); len(errors) != 1 ||
+		errors[0] != graphqlws.ErrCursorExpired {
+		t.Error("Subscriptions are resumed from expired cursors:", errors)
+	}
+	if errors := subscribe("3", "foo"); len(errors) != 1 ||
+		errors[0] != graphqlws.ErrInvalidCursor {
+		t.Error("Subscriptions are resumed from invalid cursors:", errors)
+	}
+	if len(sm.SubscriptionsForField("users", nil)) != 1 {
+		t.Error("Subscriptions that cannot be resumed are added")
+	}
+}
@@ -0,0 +1,168 @@
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Attributes recorded on spans
+const (
+	connectionIDKey   = "graphqlws.connection.id"
+	subscriptionIDKey = "graphqlws.subscription.id"
+	operationNameKey  = "graphql.operation.name"
+	fieldKey          = "graphqlws.field"
+	clientAddressKey  = "client.address"
+)
+
+// Tracer is the interface that graphqlws traces connections and
+// subscriptions with. The otel subpackage provides an implementation
+// based on OpenTelemetry; nothing is traced unless a tracer is configured.
+type Tracer interface {
+	// Extract returns a context carrying the trace context propagated by
+	// a client, e.g. in the headers of the WebSocket upgrade request or
+	// in the connection_init payload.
+	Extract(ctx context.Context, carrier TraceCarrier) context.Context
+
+	// Start starts a span as part of the trace in the context and returns
+	// a context carrying the new span.
+	Start(ctx context.Context, name string, options SpanOptions) (context.Context, Span)
+}
+
+// TraceCarrier carries the trace context propagated by clients. Its
+// methods match those of OpenTelemetry's propagation.TextMapCarrier.
+type TraceCarrier interface {
+	Get(key string) string
+	Set(key string, value string)
+	Keys() []string
+}
+
+// SpanOptions configures the spans started by a Tracer.
+type SpanOptions struct {
+	// Server marks spans covering requests from clients.
+	Server bool
+
+	// Link, if set, is a span that the new span is linked to, e.g. the
+	// span of starting the subscription an event is executed for.
+	Link Span
+
+	// Attributes describe what the span covers.
+	Attributes []SpanAttribute
+}
+
+// SpanAttribute is an attribute recorded on a span.
+type SpanAttribute struct {
+	Key   string
+	Value string
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttributes records attributes on the span.
+	SetAttributes(attributes ...SpanAttribute)
+
+	// AddEvent records an event in the span.
+	AddEvent(name string)
+
+	// End ends the span, recording the errors of the traced operation.
+	End(errs ...error)
+}
+
+// tracerOrDefault returns the configured tracer, falling back to a tracer
+// that doesn't record anything.
+func tracerOrDefault(tracer Tracer) Tracer {
+	if tracer == nil {
+		return nopTracer{}
+	}
+	return tracer
+}
+
+// headerCarrier makes the headers of requests available for extracting
+// trace context.
+type headerCarrier http.Header
+
+func (carrier headerCarrier) Get(key string) string {
+	return http.Header(carrier).Get(key)
+}
+
+func (carrier headerCarrier) Set(key string, value string) {
+	http.Header(carrier).Set(key, value)
+}
+
+func (carrier headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// payloadCarrier makes the string fields of a message payload available
+// for extracting trace context.
+type payloadCarrier map[string]string
+
+func (carrier payloadCarrier) Get(key string) string {
+	return carrier[key]
+}
+
+func (carrier payloadCarrier) Set(key string, value string) {
+	carrier[key] = value
+}
+
+func (carrier payloadCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for key := range carrier {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// carrierForPayload makes the string fields of a message payload (e.g.
+// "traceparent" in the payload of connection_init messages) available
+// for extracting trace context.
+func carrierForPayload(rawPayload json.RawMessage) payloadCarrier {
+	carrier := payloadCarrier{}
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(rawPayload, &payload); err != nil {
+		return carrier
+	}
+	for key, value := range payload {
+		if s, ok := value.(string); ok {
+			carrier[key] = s
+		}
+	}
+	return carrier
+}
+
+// subscriptionAttributes returns the span attributes identifying
+// a subscription.
+func subscriptionAttributes(
+	conn Connection,
+	subscription *Subscription,
+) []SpanAttribute {
+	return []SpanAttribute{
+		{Key: connectionIDKey, Value: conn.ID()},
+		{Key: subscriptionIDKey, Value: subscription.ID},
+		{Key: operationNameKey, Value: subscription.OperationName},
+	}
+}
+
+/**
+ * No-op tracing.
+ */
+
+type nopTracer struct{}
+
+func (nopTracer) Extract(ctx context.Context, _ TraceCarrier) context.Context {
+	return ctx
+}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ SpanOptions) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(...SpanAttribute) {}
+func (nopSpan) AddEvent(string)                {}
+func (nopSpan) End(...error)                   {}
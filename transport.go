@@ -0,0 +1,96 @@
+package graphqlws
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport is a bidirectional message stream that connections run the
+// GraphQL WebSocket protocol on. Connections read from and write to a
+// transport from different goroutines, but never read or write
+// concurrently; Close may be called at any time.
+type Transport interface {
+	// ReadMessage blocks until the next message is received. Once the
+	// transport is closed, it returns an error.
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage sends a message to the client.
+	WriteMessage([]byte) error
+
+	// Close closes the transport, notifying the client of the reason with
+	// a WebSocket close code (such as websocket.CloseNormalClosure) and
+	// text if the transport supports this. Closing a closed transport has
+	// no effect.
+	Close(code int, reason string) error
+}
+
+// BatchTransport is implemented by transports that can write several
+// messages in a single frame (see WriteBatching).
+type BatchTransport interface {
+	Transport
+
+	// WriteMessages sends several messages to the client in a single
+	// frame, separated by newlines.
+	WriteMessages([][]byte) error
+}
+
+/**
+ * The default implementation of the Transport interface, based on
+ * gorilla/websocket.
+ */
+
+var newline = []byte{'\n'}
+
+type websocketTransport struct {
+	ws *websocket.Conn
+}
+
+// NewWebSocketTransport creates a Transport from a gorilla/websocket
+// connection.
+func NewWebSocketTransport(ws *websocket.Conn) Transport {
+	ws.SetReadLimit(readLimit)
+	return &websocketTransport{ws: ws}
+}
+
+func (t *websocketTransport) ReadMessage() ([]byte, error) {
+	_, data, err := t.ws.ReadMessage()
+	return data, err
+}
+
+func (t *websocketTransport) WriteMessage(data []byte) error {
+	// If this times out, the WebSocket connection will be corrupt and
+	// has to be closed
+	t.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return t.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *websocketTransport) WriteMessages(messages [][]byte) error {
+	t.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	w, err := t.ws.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for i, data := range messages {
+		if i > 0 {
+			if _, err := w.Write(newline); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (t *websocketTransport) Close(code int, reason string) error {
+	// Sending the close message fails if the connection is closed
+	// already, which is fine
+	t.ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeTimeout),
+	)
+	return t.ws.Close()
+}